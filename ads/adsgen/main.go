@@ -0,0 +1,480 @@
+// Adsgen writes Encode, Decode, ComputeHash and CollectChildren methods for
+// the structs embedding ads.Base in the package in the current directory.
+// The generated methods produce exactly the bytes and children of the
+// reflective implementations in package ads, which they replace:
+//
+//	//go:generate adsgen
+//
+// Methods a type already declares are left alone; Encode and Decode are
+// only generated together. Setting ads.CheckGenerated compares every
+// generated method against the reflective implementation at run time.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const adsPath = "certcomp/ads"
+
+var output = flag.String("output", "ads_gen.go", "file to write")
+var typeNames = flag.String("type", "", "comma-separated types to generate for; all by default")
+
+type generator struct {
+	buffer  bytes.Buffer
+	pkg     *types.Package
+	ads     *types.Interface
+	imports map[string]string
+	depth   int
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buffer, format, args...)
+}
+
+func (g *generator) qualifier(pkg *types.Package) string {
+	if pkg == g.pkg {
+		return ""
+	}
+	g.imports[pkg.Path()] = pkg.Name()
+	return pkg.Name()
+}
+
+func (g *generator) typeString(typ types.Type) string {
+	return types.TypeString(typ, g.qualifier)
+}
+
+func (g *generator) index() string {
+	name := fmt.Sprintf("i%d", g.depth)
+	g.depth++
+	return name
+}
+
+func isByte(typ types.Type) bool {
+	return types.Identical(typ, types.Typ[types.Uint8])
+}
+
+func (g *generator) encode(expr string, typ types.Type) {
+	switch u := typ.Underlying().(type) {
+	case *types.Basic:
+		size := intSize(u)
+		switch {
+		case u.Kind() == types.Bool:
+			g.printf("e.WriteBool(%s)\n", bareConvert("bool", expr, typ))
+		case u.Info()&types.IsInteger != 0 && u.Info()&types.IsUnsigned == 0 && size > 0:
+			g.printf("e.WriteInt(int64(%s), %d)\n", expr, size)
+		case u.Info()&types.IsUnsigned != 0 && size > 0:
+			g.printf("e.WriteUint(uint64(%s), %d)\n", expr, size)
+		case u.Kind() == types.Float32:
+			g.printf("e.WriteFloat32(%s)\n", bareConvert("float32", expr, typ))
+		case u.Kind() == types.Float64:
+			g.printf("e.WriteFloat64(%s)\n", bareConvert("float64", expr, typ))
+		case u.Kind() == types.String:
+			g.printf("e.WriteString(%s)\n", bareConvert("string", expr, typ))
+		default:
+			log.Fatalf("adsgen: cannot encode %s of type %v", expr, typ)
+		}
+
+	case *types.Slice:
+		if isByte(u.Elem()) {
+			g.printf("e.WriteBytes(%s)\n", bareConvert("[]byte", expr, typ))
+			return
+		}
+
+		i := g.index()
+		g.printf("e.WriteLength(len(%s))\n", expr)
+		g.printf("for %s := range %s {\n", i, expr)
+		g.encode(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.depth--
+
+	case *types.Array:
+		i := g.index()
+		g.printf("for %s := range %s {\n", i, expr)
+		g.encode(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.depth--
+
+	default:
+		g.printf("e.Encode(&%s)\n", expr)
+	}
+}
+
+func (g *generator) decodeScalar(expr string, typ types.Type, call string) {
+	g.printf("{\n")
+	g.printf("value, err := d.%s\n", call)
+	g.printf("if err != nil {\nreturn err\n}\n")
+	g.printf("%s = %s(value)\n", expr, g.typeString(typ))
+	g.printf("}\n")
+}
+
+func (g *generator) decode(expr string, typ types.Type) {
+	switch u := typ.Underlying().(type) {
+	case *types.Basic:
+		size := intSize(u)
+		switch {
+		case u.Kind() == types.Bool:
+			g.decodeScalar(expr, typ, "ReadBool()")
+		case u.Info()&types.IsInteger != 0 && u.Info()&types.IsUnsigned == 0 && size > 0:
+			g.decodeScalar(expr, typ, fmt.Sprintf("ReadInt(%d)", size))
+		case u.Info()&types.IsUnsigned != 0 && size > 0:
+			g.decodeScalar(expr, typ, fmt.Sprintf("ReadUint(%d)", size))
+		case u.Kind() == types.Float32:
+			g.decodeScalar(expr, typ, "ReadFloat32()")
+		case u.Kind() == types.Float64:
+			g.decodeScalar(expr, typ, "ReadFloat64()")
+		case u.Kind() == types.String:
+			g.decodeScalar(expr, typ, "ReadString()")
+		default:
+			log.Fatalf("adsgen: cannot decode %s of type %v", expr, typ)
+		}
+
+	case *types.Slice:
+		if isByte(u.Elem()) {
+			g.decodeScalar(expr, typ, "ReadBytes()")
+			return
+		}
+
+		i := g.index()
+		g.printf("{\n")
+		g.printf("length, err := d.ReadLength()\n")
+		g.printf("if err != nil {\nreturn err\n}\n")
+		g.printf("%s = make(%s, length)\n", expr, g.typeString(typ))
+		g.printf("for %s := range %s {\n", i, expr)
+		g.decode(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.printf("}\n")
+		g.depth--
+
+	case *types.Array:
+		i := g.index()
+		g.printf("for %s := range %s {\n", i, expr)
+		g.decode(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.depth--
+
+	default:
+		g.printf("if err := d.Decode(&%s); err != nil {\nreturn err\n}\n", expr)
+	}
+}
+
+// mayHaveChildren reports whether values of typ can reach an ADS value.
+func mayHaveChildren(typ types.Type) bool {
+	switch u := typ.Underlying().(type) {
+	case *types.Basic:
+		return false
+	case *types.Slice:
+		return mayHaveChildren(u.Elem())
+	case *types.Array:
+		return mayHaveChildren(u.Elem())
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			if mayHaveChildren(u.Field(i).Type()) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func (g *generator) collect(expr string, typ types.Type) {
+	if !mayHaveChildren(typ) {
+		return
+	}
+
+	switch u := typ.Underlying().(type) {
+	case *types.Pointer:
+		if types.Implements(typ, g.ads) {
+			g.printf("if %s != nil {\nchildren = append(children, %s)\n}\n", expr, expr)
+			return
+		}
+
+	case *types.Interface:
+		// An interface holding a nil pointer is not nil, but has no child.
+		if types.Implements(typ, g.ads) {
+			g.printf("if !ads.IsNil(%s) {\nchildren = append(children, %s)\n}\n", expr, expr)
+			return
+		}
+
+	case *types.Slice:
+		i := g.index()
+		g.printf("for %s := range %s {\n", i, expr)
+		g.collect(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.depth--
+		return
+
+	case *types.Array:
+		i := g.index()
+		g.printf("for %s := range %s {\n", i, expr)
+		g.collect(expr+"["+i+"]", u.Elem())
+		g.printf("}\n")
+		g.depth--
+		return
+	}
+
+	g.printf("children = ads.AppendChildren(children, &%s)\n", expr)
+}
+
+func bareConvert(name, expr string, typ types.Type) string {
+	if _, ok := typ.(*types.Named); ok {
+		return name + "(" + expr + ")"
+	}
+	return expr
+}
+
+func intSize(basic *types.Basic) int {
+	switch basic.Kind() {
+	case types.Int8, types.Uint8:
+		return 1
+	case types.Int16, types.Uint16:
+		return 2
+	case types.Int32, types.Uint32:
+		return 4
+	case types.Int64, types.Uint64:
+		return 8
+	default:
+		return 0
+	}
+}
+
+type target struct {
+	name    string
+	fields  []*types.Var
+	methods []string
+}
+
+func (g *generator) generate(t target) {
+	has := make(map[string]bool)
+	for _, method := range t.methods {
+		has[method] = true
+	}
+
+	if has["Encode"] {
+		g.printf("func (x *%s) Encode(e *ads.Encoder) {\n", t.name)
+		for _, field := range t.fields {
+			g.encode("x."+field.Name(), field.Type())
+		}
+		g.printf("}\n\n")
+
+		g.printf("func (x *%s) Decode(d *ads.Decoder) error {\n", t.name)
+		for _, field := range t.fields {
+			g.decode("x."+field.Name(), field.Type())
+		}
+		g.printf("return nil\n")
+		g.printf("}\n\n")
+	}
+
+	if has["ComputeHash"] {
+		g.imports["certcomp/sha"] = "sha"
+		g.printf("func (x *%s) ComputeHash() sha.Hash {\n", t.name)
+		g.printf("return ads.EncodedHash(x)\n")
+		g.printf("}\n\n")
+	}
+
+	if has["CollectChildren"] {
+		g.printf("func (x *%s) CollectChildren() []ads.ADS {\n", t.name)
+		g.printf("children := make([]ads.ADS, 0, %d)\n", len(t.fields))
+		for _, field := range t.fields {
+			g.collect("x."+field.Name(), field.Type())
+		}
+		g.printf("return children\n")
+		g.printf("}\n\n")
+	}
+}
+
+const generatedHeader = "// Code generated by adsgen. DO NOT EDIT."
+
+// isGenerated returns whether the file called name was written by adsgen,
+// whatever its name, so that its methods are not taken as declared by hand.
+func isGenerated(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return strings.TrimSpace(line) == generatedHeader
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && !isGenerated(info.Name())
+	}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pkgs) != 1 {
+		log.Fatalf("adsgen: expected one package, found %d", len(pkgs))
+	}
+
+	var files []*ast.File
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			files = append(files, file)
+		}
+	}
+
+	// methods declared by hand, per receiver type
+	declared := make(map[string]map[string]bool)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+				continue
+			}
+			recv := fn.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if ident, ok := recv.(*ast.Ident); ok {
+				if declared[ident.Name] == nil {
+					declared[ident.Name] = make(map[string]bool)
+				}
+				declared[ident.Name][fn.Name.Name] = true
+			}
+		}
+	}
+
+	config := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(err error) {},
+	}
+	pkg, _ := config.Check(files[0].Name.Name, fset, files, nil)
+
+	var adsPkg *types.Package
+	for _, imported := range pkg.Imports() {
+		if imported.Path() == adsPath {
+			adsPkg = imported
+		}
+	}
+	if adsPkg == nil {
+		log.Fatalf("adsgen: package %s does not import %s", pkg.Name(), adsPath)
+	}
+	base := adsPkg.Scope().Lookup("Base").Type()
+
+	g := &generator{
+		pkg:     pkg,
+		ads:     adsPkg.Scope().Lookup("ADS").Type().Underlying().(*types.Interface),
+		imports: map[string]string{adsPath: "ads"},
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(*typeNames, ",") {
+		if name != "" {
+			wanted[name] = true
+		}
+	}
+
+	var targets []target
+	for _, name := range pkg.Scope().Names() {
+		obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok || (len(wanted) > 0 && !wanted[name]) {
+			continue
+		}
+		st, ok := obj.Type().Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+
+		embedsBase := false
+		for i := 0; i < st.NumFields(); i++ {
+			if field := st.Field(i); field.Anonymous() && types.Identical(field.Type(), base) {
+				embedsBase = true
+			}
+		}
+		if !embedsBase {
+			continue
+		}
+
+		t := target{name: name}
+		for i := 0; i < st.NumFields(); i++ {
+			field := st.Field(i)
+			if field.Anonymous() && types.Identical(field.Type(), base) {
+				continue
+			}
+			if !field.Exported() {
+				log.Fatalf("adsgen: %s.%s is not exported", name, field.Name())
+			}
+			t.fields = append(t.fields, field)
+		}
+
+		if !declared[name]["Encode"] && !declared[name]["Decode"] {
+			t.methods = append(t.methods, "Encode")
+		}
+		for _, method := range []string{"ComputeHash", "CollectChildren"} {
+			if !declared[name][method] {
+				t.methods = append(t.methods, method)
+			}
+		}
+		if len(t.methods) > 0 {
+			targets = append(targets, t)
+		}
+	}
+
+	for _, t := range targets {
+		g.generate(t)
+	}
+
+	if len(targets) == 0 {
+		log.Fatalf("adsgen: nothing to generate in package %s", pkg.Name())
+	}
+
+	g.printf("func init() {\n")
+	for _, t := range targets {
+		g.printf("ads.MarkGenerated(&%s{}", t.name)
+		for _, method := range t.methods {
+			g.printf(", %q", method)
+		}
+		g.printf(")\n")
+	}
+	g.printf("}\n")
+
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "%s\n\n", generatedHeader)
+	fmt.Fprintf(&header, "package %s\n\n", pkg.Name())
+	fmt.Fprintf(&header, "import (\n")
+	for _, path := range paths {
+		fmt.Fprintf(&header, "%q\n", path)
+	}
+	fmt.Fprintf(&header, ")\n\n")
+
+	source, err := format.Source(append(header.Bytes(), g.buffer.Bytes()...))
+	if err != nil {
+		log.Fatalf("adsgen: formatting output: %v", err)
+	}
+
+	if err := ioutil.WriteFile(*output, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
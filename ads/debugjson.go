@@ -0,0 +1,456 @@
+package ads
+
+import (
+	"bytes"
+	"certcomp/sha"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// The debug JSON form of a value follows its Go structure:
+//
+//   - structs are objects keyed by field name, without Base,
+//   - opaque ADS values are {"opaque": "<hash>"},
+//   - interface values are {"type": "<name>", "value": ...} or
+//     {"func": "<name>"}, using names from the Registry selected with
+//     UseRegistry,
+//   - byte slices and arrays are hex strings,
+//   - maps with string keys are objects, other maps are arrays of
+//     {"key": ..., "value": ...} in canonical order,
+//   - anything implementing encoding.TextMarshaler is a string.
+//
+// Unexported fields are left out.
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// MarshalDebugJSON renders the value ptrToValue points to as indented JSON,
+// for reading rather than for exchange.
+func MarshalDebugJSON(ptrToValue interface{}) ([]byte, error) {
+	v := reflect.ValueOf(ptrToValue)
+	if v.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("ads: cannot marshal non-pointer %v", v.Type())
+	}
+
+	var buffer bytes.Buffer
+	if err := writeDebugJSON(&buffer, v.Elem()); err != nil {
+		return nil, err
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buffer.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+func writeJSON(b *bytes.Buffer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.Write(data)
+	return nil
+}
+
+func writeDebugJSON(b *bytes.Buffer, v reflect.Value) error {
+	if v.CanInterface() && v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		return writeJSON(b, string(text))
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return writeJSON(b, v.Bool())
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeJSON(b, v.Int())
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return writeJSON(b, v.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		return writeJSON(b, v.Float())
+
+	case reflect.String:
+		return writeJSON(b, v.String())
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return writeJSON(b, hex.EncodeToString(data))
+		}
+
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			if err := writeDebugJSON(b, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		b.WriteString("]")
+
+	case reflect.Map:
+		if err := checkMapKey(v.Type().Key()); err != nil {
+			return err
+		}
+
+		byName := v.Type().Key().Kind() == reflect.String
+		if byName {
+			b.WriteString("{")
+		} else {
+			b.WriteString("[")
+		}
+		for i, key := range sortedMapKeys(v) {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			if byName {
+				writeJSON(b, key.value.String())
+				b.WriteString(":")
+			} else {
+				b.WriteString(`{"key":`)
+				if err := writeDebugJSON(b, key.value); err != nil {
+					return err
+				}
+				b.WriteString(`,"value":`)
+			}
+			if err := writeDebugJSON(b, v.MapIndex(key.value)); err != nil {
+				return err
+			}
+			if !byName {
+				b.WriteString("}")
+			}
+		}
+		if byName {
+			b.WriteString("}")
+		} else {
+			b.WriteString("]")
+		}
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		if value, ok := v.Interface().(ADS); ok && value.IsOpaque() {
+			b.WriteString(`{"opaque":`)
+			writeJSON(b, Hash(value).String())
+			b.WriteString("}")
+			return nil
+		}
+		return writeDebugJSON(b, v.Elem())
+
+	case reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+
+		if v.Elem().Kind() == reflect.Func {
+			name, found := HashRegistry().FuncName(v.Elem().Interface())
+			if !found {
+				return fmt.Errorf("ads: unregistered func %v", v.Elem().Type())
+			}
+			b.WriteString(`{"func":`)
+			writeJSON(b, name)
+			b.WriteString("}")
+			return nil
+		}
+
+		name, found := HashRegistry().TypeName(v.Elem().Type())
+		if !found {
+			return fmt.Errorf("ads: unregistered type %v", v.Elem().Type())
+		}
+		b.WriteString(`{"type":`)
+		writeJSON(b, name)
+		b.WriteString(`,"value":`)
+		if err := writeDebugJSON(b, v.Elem()); err != nil {
+			return err
+		}
+		b.WriteString("}")
+
+	case reflect.Struct:
+		b.WriteString("{")
+		first := true
+		typ := v.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type == baseValueType && field.Anonymous || field.PkgPath != "" {
+				continue
+			}
+
+			if !first {
+				b.WriteString(",")
+			}
+			first = false
+
+			writeJSON(b, field.Name)
+			b.WriteString(":")
+			if err := writeDebugJSON(b, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		b.WriteString("}")
+
+	default:
+		return fmt.Errorf("ads: cannot marshal %v", v.Type())
+	}
+
+	return nil
+}
+
+// UnmarshalDebugJSON is the inverse of MarshalDebugJSON, for writing test
+// fixtures by hand. Missing fields are left zero.
+func UnmarshalDebugJSON(data []byte, ptrToValue interface{}) error {
+	v := reflect.ValueOf(ptrToValue)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("ads: cannot unmarshal into non-pointer %v", v.Type())
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return err
+	}
+	return readDebugJSON(tree, v.Elem())
+}
+
+func debugJSONError(v reflect.Value, tree interface{}) error {
+	return fmt.Errorf("ads: cannot unmarshal %T into %v", tree, v.Type())
+}
+
+func readDebugJSON(tree interface{}, v reflect.Value) error {
+	if tree == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		text, ok := tree.(string)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		value, ok := tree.(bool)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		v.SetBool(value)
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := tree.(json.Number)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		value, err := strconv.ParseInt(string(number), 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("ads: bad %v: %v", v.Type(), err)
+		}
+		v.SetInt(value)
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := tree.(json.Number)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		value, err := strconv.ParseUint(string(number), 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("ads: bad %v: %v", v.Type(), err)
+		}
+		v.SetUint(value)
+
+	case reflect.Float32, reflect.Float64:
+		number, ok := tree.(json.Number)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		value, err := strconv.ParseFloat(string(number), v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("ads: bad %v: %v", v.Type(), err)
+		}
+		v.SetFloat(value)
+
+	case reflect.String:
+		value, ok := tree.(string)
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		v.SetString(value)
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			text, ok := tree.(string)
+			if !ok {
+				return debugJSONError(v, tree)
+			}
+			data, err := hex.DecodeString(text)
+			if err != nil {
+				return fmt.Errorf("ads: bad %v: %v", v.Type(), err)
+			}
+			if v.Kind() == reflect.Slice {
+				v.Set(reflect.MakeSlice(v.Type(), len(data), len(data)))
+			} else if len(data) != v.Len() {
+				return fmt.Errorf("ads: expected %d bytes for %v, got %d", v.Len(), v.Type(), len(data))
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+
+		elems, ok := tree.([]interface{})
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(elems), len(elems)))
+		} else if len(elems) != v.Len() {
+			return fmt.Errorf("ads: expected %d elements for %v, got %d", v.Len(), v.Type(), len(elems))
+		}
+		for i, elem := range elems {
+			if err := readDebugJSON(elem, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		typ := v.Type()
+		if err := checkMapKey(typ.Key()); err != nil {
+			return err
+		}
+
+		m := reflect.MakeMap(typ)
+		if typ.Key().Kind() == reflect.String {
+			object, ok := tree.(map[string]interface{})
+			if !ok {
+				return debugJSONError(v, tree)
+			}
+			for name, elem := range object {
+				value := reflect.New(typ.Elem()).Elem()
+				if err := readDebugJSON(elem, value); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(name).Convert(typ.Key()), value)
+			}
+		} else {
+			entries, ok := tree.([]interface{})
+			if !ok {
+				return debugJSONError(v, tree)
+			}
+			for _, entry := range entries {
+				object, ok := entry.(map[string]interface{})
+				if !ok {
+					return debugJSONError(v, entry)
+				}
+				key := reflect.New(typ.Key()).Elem()
+				if err := readDebugJSON(object["key"], key); err != nil {
+					return err
+				}
+				value := reflect.New(typ.Elem()).Elem()
+				if err := readDebugJSON(object["value"], value); err != nil {
+					return err
+				}
+				m.SetMapIndex(key, value)
+			}
+		}
+		v.Set(m)
+
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+
+		if value, ok := v.Interface().(ADS); ok {
+			if object, ok := tree.(map[string]interface{}); ok && len(object) == 1 && object["opaque"] != nil {
+				text, _ := object["opaque"].(string)
+				data, err := hex.DecodeString(text)
+				var hash sha.Hash
+				if err != nil || len(data) != len(hash) {
+					return fmt.Errorf("ads: bad opaque hash %v", object["opaque"])
+				}
+				copy(hash[:], data)
+				value.SetCachedHash(hash)
+				value.MakeOpaque()
+				return nil
+			}
+		}
+		return readDebugJSON(tree, v.Elem())
+
+	case reflect.Interface:
+		object, ok := tree.(map[string]interface{})
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+
+		if name, ok := object["func"].(string); ok {
+			f, found := HashRegistry().LookupFunc(name)
+			if !found {
+				return &UnknownFuncError{Name: name}
+			}
+			fv := reflect.ValueOf(f)
+			if !fv.Type().AssignableTo(v.Type()) {
+				return fmt.Errorf("ads: func %v does not fit in %v", fv.Type(), v.Type())
+			}
+			v.Set(fv)
+			return nil
+		}
+
+		name, ok := object["type"].(string)
+		if !ok {
+			return fmt.Errorf("ads: interface value %v has no type", object)
+		}
+		typ, found := HashRegistry().LookupType(name)
+		if !found {
+			return &UnknownTypeError{Name: name}
+		}
+		if !typ.AssignableTo(v.Type()) {
+			return fmt.Errorf("ads: %v does not fit in %v", typ, v.Type())
+		}
+		value := reflect.New(typ).Elem()
+		if err := readDebugJSON(object["value"], value); err != nil {
+			return err
+		}
+		v.Set(value)
+
+	case reflect.Struct:
+		object, ok := tree.(map[string]interface{})
+		if !ok {
+			return debugJSONError(v, tree)
+		}
+
+		typ := v.Type()
+		for name, elem := range object {
+			field, found := typ.FieldByName(name)
+			if !found || field.PkgPath != "" || len(field.Index) != 1 {
+				return fmt.Errorf("ads: %v has no field %q", typ, name)
+			}
+			if err := readDebugJSON(elem, v.Field(field.Index[0])); err != nil {
+				return fmt.Errorf("%v.%s: %v", typ, name, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("ads: cannot unmarshal %v", v.Type())
+	}
+
+	return nil
+}
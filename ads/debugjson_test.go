@@ -0,0 +1,31 @@
+package ads
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDebugJSON(t *testing.T) {
+	n := makeTestNode()
+	n.Child.(*testNode).MakeOpaque()
+	m := &testMap{
+		Counts:   map[string]int32{"a": 1, "b": 2},
+		Children: map[int64]*testNode{3: n},
+	}
+
+	data, err := MarshalDebugJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"opaque": "`+Hash(n.Child.(ADS)).String()+`"`)) {
+		t.Fatalf("opaque child not rendered by hash:\n%s", data)
+	}
+
+	var decoded *testMap
+	if err := UnmarshalDebugJSON(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if Hash(decoded) != Hash(m) {
+		t.Fatalf("hash changed in round trip:\n%s", data)
+	}
+}
@@ -0,0 +1,196 @@
+package ads
+
+import (
+	"certcomp/sha"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A Loader makes opaque values transparent. comp.C satisfies it; PagingC,
+// for one, pages opaque values in from its DB.
+type Loader interface {
+	Use(values ...ADS)
+}
+
+// A Difference is a pair of values with different hashes at the same path
+// whose difference lies in the values themselves rather than in their
+// children.
+type Difference struct {
+	// Path is the sequence of fields, indices and map keys leading from
+	// the roots to the values, such as "Left.ArgsOrResults[0]".
+	Path         string
+	AType, BType string
+	AHash, BHash sha.Hash
+}
+
+func (d Difference) String() string {
+	path := d.Path
+	if path == "" {
+		path = "(root)"
+	}
+	if d.AType != d.BType {
+		return fmt.Sprintf("%s: %s %v != %s %v", path, d.AType, d.AHash, d.BType, d.BHash)
+	}
+	return fmt.Sprintf("%s: %s %v != %v", path, d.AType, d.AHash, d.BHash)
+}
+
+// Diff walks a and b in lockstep, skipping pairs of subtrees with equal
+// hashes, and returns the deepest pairs of values that differ. Opaque values
+// are made transparent with loader; if loader is nil, or cannot load them,
+// they are reported as they are.
+func Diff(a, b ADS, loader Loader) []Difference {
+	d := &differ{loader: loader}
+	d.node("", a, b)
+	return d.diffs
+}
+
+type differ struct {
+	loader Loader
+	diffs  []Difference
+}
+
+func typeName(typ reflect.Type) string {
+	if name, found := HashRegistry().TypeName(typ); found {
+		return name
+	}
+	return typ.String()
+}
+
+func (d *differ) report(path string, a, b ADS) {
+	d.diffs = append(d.diffs, Difference{
+		Path:  path,
+		AType: typeName(reflect.TypeOf(a)),
+		BType: typeName(reflect.TypeOf(b)),
+		AHash: Hash(a),
+		BHash: Hash(b),
+	})
+}
+
+func (d *differ) load(values ...ADS) bool {
+	for _, value := range values {
+		if value.IsOpaque() {
+			if d.loader == nil {
+				return false
+			}
+			d.loader.Use(value)
+			if value.IsOpaque() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (d *differ) node(path string, a, b ADS) {
+	if Hash(a) == Hash(b) {
+		return
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !d.load(a, b) {
+		d.report(path, a, b)
+		return
+	}
+
+	before := len(d.diffs)
+	same := d.value(path, reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem())
+	if !same || len(d.diffs) == before {
+		d.report(path, a, b)
+	}
+}
+
+func join(path, field string) string {
+	if path == "" || strings.HasPrefix(field, "[") {
+		return path + field
+	}
+	return path + "." + field
+}
+
+// value compares a and b, which have the same type, and reports whether
+// they are equal apart from the ADS values they contain. Differing ADS
+// values are handed to node.
+func (d *differ) value(path string, a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+
+	case reflect.String:
+		return a.String() == b.String()
+
+	case reflect.Func:
+		return a.Pointer() == b.Pointer()
+
+	case reflect.Slice, reflect.Array:
+		same := a.Len() == b.Len()
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			if !d.value(join(path, fmt.Sprintf("[%d]", i)), a.Index(i), b.Index(i)) {
+				same = false
+			}
+		}
+		return same
+
+	case reflect.Map:
+		same := a.Len() == b.Len()
+		for _, key := range sortedMapKeys(a) {
+			vb := b.MapIndex(key.value)
+			if !vb.IsValid() {
+				same = false
+				continue
+			}
+			if !d.value(join(path, fmt.Sprintf("[%v]", key.value)), a.MapIndex(key.value), vb) {
+				same = false
+			}
+		}
+		return same
+
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if va, ok := a.Interface().(ADS); ok {
+			d.node(path, va, b.Interface().(ADS))
+			return true
+		}
+		return d.value(path, a.Elem(), b.Elem())
+
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			va, aok := a.Elem().Interface().(ADS)
+			vb, bok := b.Elem().Interface().(ADS)
+			if aok && bok {
+				d.report(path, va, vb)
+				return true
+			}
+			return false
+		}
+		return d.value(path, a.Elem(), b.Elem())
+
+	case reflect.Struct:
+		same := true
+		typ := a.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type == baseValueType && field.Anonymous {
+				continue
+			}
+			if !d.value(join(path, field.Name), a.Field(i), b.Field(i)) {
+				same = false
+			}
+		}
+		return same
+
+	default:
+		panic(a.Type())
+	}
+}
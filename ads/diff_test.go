@@ -0,0 +1,49 @@
+package ads
+
+import "testing"
+
+type transparentLoader struct{}
+
+func (transparentLoader) Use(values ...ADS) {
+	for _, value := range values {
+		value.MakeTransparent()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, b := makeTestNode(), makeTestNode()
+	if diffs := Diff(a, b, nil); len(diffs) != 0 {
+		t.Errorf("equal trees differ: %v", diffs)
+	}
+
+	// Hashes are cached, so each case starts from fresh trees.
+	a, b = makeTestNode(), makeTestNode()
+	b.Left.Child = int64(6)
+	b.Child.(*testNode).Items = []int64{4}
+	b.Child.(*testNode).MakeOpaque()
+
+	diffs := Diff(a, b, nil)
+	if len(diffs) != 2 || diffs[0].Path != "Left" || diffs[1].Path != "Child" {
+		t.Fatalf("unexpected differences: %v", diffs)
+	}
+	if diffs[0].AType != "ads_test.testNode" || diffs[0].AHash != Hash(a.Left) || diffs[0].BHash != Hash(b.Left) {
+		t.Errorf("unexpected difference: %+v", diffs[0])
+	}
+
+	a, b = makeTestNode(), makeTestNode()
+	a.Child.(*testNode).Left = &testNode{Name: "old"}
+	b.Child.(*testNode).Left = &testNode{Name: "new"}
+	b.Child.(*testNode).MakeOpaque()
+	if diffs := Diff(a, b, nil); len(diffs) != 1 || diffs[0].Path != "Child" {
+		t.Errorf("unexpected differences without loader: %v", diffs)
+	}
+	if diffs := Diff(a, b, transparentLoader{}); len(diffs) != 1 || diffs[0].Path != "Child.Left" {
+		t.Errorf("unexpected differences with loader: %v", diffs)
+	}
+
+	a, b = makeTestNode(), makeTestNode()
+	b.Child = int64(1)
+	if diffs := Diff(a, b, nil); len(diffs) != 1 || diffs[0].Path != "" {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+}
@@ -0,0 +1,88 @@
+package ads
+
+import (
+	"certcomp/sha"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrTruncated = errors.New("ads: truncated input")
+var ErrTrailingBytes = errors.New("ads: trailing bytes after value")
+
+// UnknownTypeError reports a type tag that is not registered. Name is set
+// when the tag was a name rather than a Registry id.
+type UnknownTypeError struct {
+	Id   int8
+	Name string
+}
+
+func (e *UnknownTypeError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("ads: unknown type %q", e.Name)
+	}
+	return fmt.Sprintf("ads: unknown type id %d", e.Id)
+}
+
+type UnknownFuncError struct {
+	Id   int8
+	Name string
+}
+
+func (e *UnknownFuncError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("ads: unknown func %q", e.Name)
+	}
+	return fmt.Sprintf("ads: unknown func id %d", e.Id)
+}
+
+// MalformedError reports input that is well-framed but describes a value
+// that cannot exist, such as a negative length or a bad marker byte.
+type MalformedError struct {
+	Reason string
+}
+
+func (e *MalformedError) Error() string {
+	return "ads: malformed input: " + e.Reason
+}
+
+// LimitError reports input that exceeds one of the configured
+// DecoderLimits.
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("ads: input exceeds %s limit of %d", e.Limit, e.Max)
+}
+
+// FingerprintError reports data produced under a registry whose types or
+// functions differ from the one reading it.
+type FingerprintError struct {
+	Expected, Actual sha.Hash
+}
+
+func (e *FingerprintError) Error() string {
+	return fmt.Sprintf("ads: data has registry fingerprint %v, expected %v; it was produced with different types or functions", e.Actual, e.Expected)
+}
+
+// ReadError maps the io errors returned for short reads onto ErrTruncated,
+// so that Encodeable implementations reading through other libraries
+// report the same error as the reflective decoder.
+func ReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// OpaqueError reports an opaque value that Walk could not see into.
+type OpaqueError struct {
+	Path string
+	Hash sha.Hash
+}
+
+func (e *OpaqueError) Error() string {
+	return fmt.Sprintf("ads: value at %q (%v) is opaque", e.Path, e.Hash)
+}
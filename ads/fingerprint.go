@@ -0,0 +1,79 @@
+package ads
+
+import (
+	"bytes"
+	"certcomp/sha"
+	"fmt"
+	"reflect"
+)
+
+// Fingerprint hashes a canonical description of everything in the registry
+// that affects the meaning of encoded data: the id and name of every type
+// and function, the field layout of every type and the signature of every
+// function, as well as the process's sha.Hasher and sha.Scheme. Data encoded under one
+// fingerprint can only be decoded under the same one.
+func (r *Registry) Fingerprint() sha.Hash {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "hasher %v\n", sha.Current())
+	fmt.Fprintf(&buffer, "scheme %v\n", sha.CurrentScheme())
+
+	if r != nil {
+		for id, name := range r.types {
+			typ := r.idToType[int8(id)]
+			fmt.Fprintf(&buffer, "type %d %s %s\n", id, name, r.describe(typ, true, make(map[reflect.Type]bool)))
+		}
+		for id, name := range r.funcs {
+			f := r.idToFunc[int8(id)]
+			fmt.Fprintf(&buffer, "func %d %s %v\n", id, name, reflect.TypeOf(f))
+		}
+	}
+
+	// The fingerprint itself must not depend on the hasher it describes.
+	return sha.SHA256.Sum(buffer.Bytes())
+}
+
+// describe spells out the layout of typ. Registered types nested inside
+// another type are referred to by name, as their own entry describes them.
+func (r *Registry) describe(typ reflect.Type, top bool, seen map[reflect.Type]bool) string {
+	if id, found := r.typeToId[typ]; found && !top {
+		return r.types[id]
+	}
+	if seen[typ] {
+		return typ.String()
+	}
+	seen[typ] = true
+	defer delete(seen, typ)
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return "*" + r.describe(typ.Elem(), false, seen)
+
+	case reflect.Slice:
+		return "[]" + r.describe(typ.Elem(), false, seen)
+
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", typ.Len(), r.describe(typ.Elem(), false, seen))
+
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", r.describe(typ.Key(), false, seen), r.describe(typ.Elem(), false, seen))
+
+	case reflect.Interface:
+		return "interface"
+
+	case reflect.Struct:
+		var buffer bytes.Buffer
+		buffer.WriteString("struct{")
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type == baseValueType && field.Anonymous {
+				continue
+			}
+			fmt.Fprintf(&buffer, "%s %s;", field.Name, r.describe(field.Type, false, seen))
+		}
+		buffer.WriteString("}")
+		return buffer.String()
+
+	default:
+		return typ.Kind().String()
+	}
+}
@@ -0,0 +1,240 @@
+package ads
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Format selects the wire encoding used by an Encoder or Decoder.
+// FixedFormat writes lengths as int32 and integers at their full width;
+// CompactFormat writes lengths and unsigned integers as varints and signed
+// integers as zigzag varints. Hashes are always computed over FixedFormat,
+// so the choice of format only affects the size of proofs.
+type Format uint8
+
+const (
+	FixedFormat Format = iota
+	CompactFormat
+)
+
+func (f Format) String() string {
+	switch f {
+	case FixedFormat:
+		return "fixed"
+	case CompactFormat:
+		return "compact"
+	default:
+		return fmt.Sprintf("Format(%d)", uint8(f))
+	}
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "fixed":
+		return FixedFormat, nil
+	case "compact":
+		return CompactFormat, nil
+	default:
+		return 0, fmt.Errorf("ads: unknown format %q", name)
+	}
+}
+
+func (e *Encoder) writeUvarint(value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], value)
+	e.Write(buffer[:n])
+}
+
+// WriteLength writes the length of a string, slice or map.
+func (e *Encoder) WriteLength(length int) {
+	if e.Format == CompactFormat {
+		e.writeUvarint(uint64(length))
+	} else {
+		e.writeLE(int32(length))
+	}
+}
+
+// WriteInt writes a signed integer that is size bytes wide in memory.
+func (e *Encoder) WriteInt(value int64, size int) {
+	if e.Format == CompactFormat && size > 1 {
+		e.writeUvarint(uint64(value<<1) ^ uint64(value>>63))
+		return
+	}
+
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], uint64(value))
+	e.Write(buffer[:size])
+}
+
+// WriteUint writes an unsigned integer that is size bytes wide in memory.
+func (e *Encoder) WriteUint(value uint64, size int) {
+	if e.Format == CompactFormat && size > 1 {
+		e.writeUvarint(value)
+		return
+	}
+
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], value)
+	e.Write(buffer[:size])
+}
+
+func (e *Encoder) WriteBool(value bool) {
+	if value {
+		e.Write([]byte{1})
+	} else {
+		e.Write([]byte{0})
+	}
+}
+
+func (e *Encoder) WriteFloat32(value float32) {
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], math.Float32bits(value))
+	e.Write(buffer[:])
+}
+
+func (e *Encoder) WriteFloat64(value float64) {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(value))
+	e.Write(buffer[:])
+}
+
+func (e *Encoder) WriteString(value string) {
+	e.WriteLength(len(value))
+	io.WriteString(e, value)
+}
+
+func (e *Encoder) WriteBytes(value []byte) {
+	e.WriteLength(len(value))
+	e.Write(value)
+}
+
+func (d *Decoder) ReadByte() (byte, error) {
+	var buffer [1]byte
+	if err := d.ReadFull(buffer[:]); err != nil {
+		return 0, err
+	}
+	return buffer[0], nil
+}
+
+func (d *Decoder) readUvarint() (uint64, error) {
+	value, err := binary.ReadUvarint(d)
+	if err == nil || err == ErrTruncated {
+		return value, err
+	}
+	if _, ok := err.(*LimitError); ok {
+		return value, err
+	}
+	return 0, &MalformedError{"varint overflows 64 bits"}
+}
+
+// ReadLength reads a length written by WriteLength, enforcing MaxLength.
+func (d *Decoder) ReadLength() (int, error) {
+	var length int64
+
+	if d.Format == CompactFormat {
+		value, err := d.readUvarint()
+		if err != nil {
+			return 0, err
+		}
+		if value > math.MaxInt32 {
+			return 0, &MalformedError{fmt.Sprintf("length %d too large", value)}
+		}
+		length = int64(value)
+	} else {
+		var value int32
+		if err := d.readLE(&value); err != nil {
+			return 0, err
+		}
+		if value < 0 {
+			return 0, &MalformedError{fmt.Sprintf("negative length %d", value)}
+		}
+		length = int64(value)
+	}
+
+	if d.Limits.MaxLength > 0 && length > int64(d.Limits.MaxLength) {
+		return 0, &LimitError{"length", int64(d.Limits.MaxLength)}
+	}
+	return int(length), nil
+}
+
+func (d *Decoder) ReadBool() (bool, error) {
+	b, err := d.ReadByte()
+	return b != 0, err
+}
+
+func (d *Decoder) ReadFloat32() (float32, error) {
+	var buffer [4]byte
+	if err := d.ReadFull(buffer[:]); err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(buffer[:])), nil
+}
+
+func (d *Decoder) ReadFloat64() (float64, error) {
+	var buffer [8]byte
+	if err := d.ReadFull(buffer[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buffer[:])), nil
+}
+
+func (d *Decoder) ReadBytes() ([]byte, error) {
+	length, err := d.ReadLength()
+	if err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, length)
+	if err := d.ReadFull(buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (d *Decoder) ReadString() (string, error) {
+	buffer, err := d.ReadBytes()
+	return string(buffer), err
+}
+
+// ReadInt reads a signed integer written by WriteInt with the same size.
+func (d *Decoder) ReadInt(size int) (int64, error) {
+	if d.Format == CompactFormat && size > 1 {
+		value, err := d.readUvarint()
+		if err != nil {
+			return 0, err
+		}
+		signed := int64(value>>1) ^ -int64(value&1)
+		if bits := uint(size * 8); bits < 64 && signed != signed<<(64-bits)>>(64-bits) {
+			return 0, &MalformedError{fmt.Sprintf("%d does not fit in %d bytes", signed, size)}
+		}
+		return signed, nil
+	}
+
+	var buffer [8]byte
+	if err := d.ReadFull(buffer[:size]); err != nil {
+		return 0, err
+	}
+	shift := uint(64 - size*8)
+	return int64(binary.LittleEndian.Uint64(buffer[:])<<shift) >> shift, nil
+}
+
+// ReadUint reads an unsigned integer written by WriteUint with the same size.
+func (d *Decoder) ReadUint(size int) (uint64, error) {
+	if d.Format == CompactFormat && size > 1 {
+		value, err := d.readUvarint()
+		if err != nil {
+			return 0, err
+		}
+		if bits := uint(size * 8); bits < 64 && value>>bits != 0 {
+			return 0, &MalformedError{fmt.Sprintf("%d does not fit in %d bytes", value, size)}
+		}
+		return value, nil
+	}
+
+	var buffer [8]byte
+	if err := d.ReadFull(buffer[:size]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buffer[:]), nil
+}
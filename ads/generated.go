@@ -0,0 +1,135 @@
+package ads
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// Types with methods generated by adsgen register themselves here, along
+// with the names of the generated methods, so that those methods can be
+// compared against the reflective implementations.
+var generatedTypes = make(map[reflect.Type]map[string]bool)
+
+// CheckGenerated makes every Encoder run SelfCheck on generated types
+// before encoding them, panicking on the first mismatch.
+var CheckGenerated = false
+
+func MarkGenerated(instance interface{}, methods ...string) {
+	set := make(map[string]bool)
+	for _, method := range methods {
+		set[method] = true
+	}
+	generatedTypes[reflect.TypeOf(instance)] = set
+}
+
+func isGenerated(typ reflect.Type) bool {
+	_, found := generatedTypes[typ]
+	return found
+}
+
+// AppendChildren appends the ADS values reachable from *ptrToValue without
+// passing through another ADS value, as CollectChildren does for a struct.
+func AppendChildren(children []ADS, ptrToValue interface{}) []ADS {
+	collectChildren(reflect.ValueOf(ptrToValue).Elem(), &children)
+	return children
+}
+
+// IsNil returns whether value is nil or holds a nil pointer, which, like
+// CollectChildren, generated methods do not take as a child.
+func IsNil(value ADS) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// SelfCheck compares the Encodeable, Collectable and Hashable methods of
+// value against the reflective implementations they replace. For types
+// marked with MarkGenerated only the generated methods are checked.
+func SelfCheck(value ADS) error {
+	v := reflect.ValueOf(value)
+	typ := v.Type()
+
+	check := func(method string) bool {
+		if methods, found := generatedTypes[typ]; found {
+			return methods[method]
+		}
+		return true
+	}
+
+	var expected bytes.Buffer
+	e := Encoder{Writer: &expected}
+	e.encode(v.Elem())
+
+	if encodeable, ok := value.(Encodeable); ok && check("Encode") {
+		var actual bytes.Buffer
+		e := Encoder{Writer: &actual}
+		encodeable.Encode(&e)
+
+		if err := compareEncodings(typ, "Encode", expected.Bytes(), actual.Bytes()); err != nil {
+			return err
+		}
+
+		decoded := reflect.New(typ.Elem())
+		d := Decoder{Reader: bytes.NewReader(actual.Bytes())}
+		if err := decoded.Interface().(Encodeable).Decode(&d); err != nil {
+			return fmt.Errorf("ads: %v.Decode: %v", typ, err)
+		}
+		if err := d.Finish(); err != nil {
+			return fmt.Errorf("ads: %v.Decode: %v", typ, err)
+		}
+
+		var roundTrip bytes.Buffer
+		e = Encoder{Writer: &roundTrip}
+		e.encode(decoded.Elem())
+		if err := compareEncodings(typ, "Decode", expected.Bytes(), roundTrip.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if collectable, ok := value.(Collectable); ok && check("CollectChildren") {
+		expected := make([]ADS, 0)
+		collectChildren(v.Elem(), &expected)
+		actual := collectable.CollectChildren()
+
+		if len(expected) != len(actual) {
+			return fmt.Errorf("ads: %v.CollectChildren returned %d children, expected %d", typ, len(actual), len(expected))
+		}
+		for i := range expected {
+			if expected[i] != actual[i] {
+				return fmt.Errorf("ads: %v.CollectChildren differs at child %d", typ, i)
+			}
+		}
+	}
+
+	if hashable, ok := value.(Hashable); ok && check("ComputeHash") {
+		var buffer bytes.Buffer
+		e := Encoder{
+			Writer:      &buffer,
+			Transparent: map[ADS]bool{value: true},
+			reflective:  value,
+		}
+		e.Encode(&value)
+
+		if expected, actual := encodedSum(buffer.Bytes()), hashable.ComputeHash(); expected != actual {
+			return fmt.Errorf("ads: %v.ComputeHash returned %v, expected %v", typ, actual, expected)
+		}
+	}
+
+	return nil
+}
+
+func compareEncodings(typ reflect.Type, method string, expected, actual []byte) error {
+	if bytes.Equal(expected, actual) {
+		return nil
+	}
+
+	i := 0
+	for i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+		i++
+	}
+	return fmt.Errorf("ads: %v.%s differs from reflective encoding at byte %d (%d vs %d bytes)",
+		typ, method, i, len(actual), len(expected))
+}
@@ -0,0 +1,74 @@
+package ads
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Maps are encoded as their entries sorted by the FixedFormat encoding of
+// their keys, so that equal maps always hash the same. Keys are restricted to types
+// whose encoding does not depend on the set of transparent values.
+
+func checkMapKey(typ reflect.Type) error {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.String:
+		return nil
+
+	case reflect.Array:
+		return checkMapKey(typ.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type == baseValueType && field.Anonymous {
+				return fmt.Errorf("ads: map key %v embeds Base", typ)
+			}
+			if err := checkMapKey(field.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("ads: unsupported map key %v", typ)
+	}
+}
+
+func encodeMapKey(key reflect.Value) []byte {
+	buffer := new(bytes.Buffer)
+	e := Encoder{
+		Writer: buffer,
+	}
+	e.encode(key)
+	return buffer.Bytes()
+}
+
+type mapKey struct {
+	value   reflect.Value
+	encoded []byte
+}
+
+type mapKeys []mapKey
+
+func (k mapKeys) Len() int           { return len(k) }
+func (k mapKeys) Less(i, j int) bool { return bytes.Compare(k[i].encoded, k[j].encoded) < 0 }
+func (k mapKeys) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+func sortedMapKeys(v reflect.Value) mapKeys {
+	if err := checkMapKey(v.Type().Key()); err != nil {
+		panic(err)
+	}
+
+	keys := make(mapKeys, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, mapKey{
+			value:   key,
+			encoded: encodeMapKey(key),
+		})
+	}
+	sort.Sort(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+package ads
+
+import (
+	"certcomp/sha"
+	"sync"
+	"sync/atomic"
+)
+
+type hashTask struct {
+	value   ADS
+	pending int32
+	parents []*hashTask
+}
+
+// HashParallel computes the same hash as Hash, but fills in missing cached
+// hashes bottom-up using workers goroutines: a value is hashed once all of
+// its children (as returned by CollectChildren) are. Values that already
+// have a cached hash are not visited, so after a small change to a large
+// tree only the changed path is rehashed.
+func HashParallel(root ADS, workers int) sha.Hash {
+	if workers <= 1 {
+		return Hash(root)
+	}
+
+	tasks := make(map[ADS]*hashTask)
+	var ready []*hashTask
+
+	var visit func(value ADS) *hashTask
+	visit = func(value ADS) *hashTask {
+		if task, found := tasks[value]; found {
+			return task
+		}
+		if value.CachedHash() != nil {
+			return nil
+		}
+
+		task := &hashTask{value: value}
+		tasks[value] = task
+		for _, child := range CollectChildren(value) {
+			if childTask := visit(child); childTask != nil {
+				childTask.parents = append(childTask.parents, task)
+				task.pending++
+			}
+		}
+
+		if task.pending == 0 {
+			ready = append(ready, task)
+		}
+		return task
+	}
+	visit(root)
+
+	if len(tasks) == 0 {
+		return Hash(root)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(tasks))
+
+	work := make(chan *hashTask, len(tasks))
+	for _, task := range ready {
+		work <- task
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range work {
+				Hash(task.value)
+				for _, parent := range task.parents {
+					if atomic.AddInt32(&parent.pending, -1) == 0 {
+						work <- parent
+					}
+				}
+				wg.Done()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(work)
+
+	return Hash(root)
+}
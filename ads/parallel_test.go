@@ -0,0 +1,22 @@
+package ads
+
+import "testing"
+
+func TestHashParallel(t *testing.T) {
+	build := func() *testNode {
+		var nodes []*testNode
+		for i := 0; i < 1000; i++ {
+			n := &testNode{Value: int32(i)}
+			if i > 0 {
+				n.Left = nodes[(i-1)/2]
+				n.Child = nodes[i/3]
+			}
+			nodes = append(nodes, n)
+		}
+		return nodes[len(nodes)-1]
+	}
+
+	if Hash(build()) != HashParallel(build(), 4) {
+		t.Fatalf("HashParallel differs from Hash")
+	}
+}
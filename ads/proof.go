@@ -0,0 +1,308 @@
+package ads
+
+import (
+	"bytes"
+	"certcomp/sha"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// A proof container holds a single root value together with everything
+// needed to decode and check it:
+//
+//	magic       "ADSP"
+//	version     uint8
+//	fingerprint [32]byte, of the registry the payload was encoded with
+//	format      uint8, the Format of the payload
+//	compression uint8
+//	flags       uint8, since version 2
+//	hasher      uint8, the sha.Hasher of all hashes, since version 3
+//	scheme      uint8, the sha.Scheme of all hashes, since version 4
+//	root type   string, the registered name of the root's type
+//	root hash   [32]byte
+//	payload     the root, possibly compressed
+//
+// The header is always written in FixedFormat and never compressed.
+const proofMagic = "ADSP"
+
+const ProofVersion = 4
+
+// Proof flags.
+const (
+	proofDedup = 1 << iota
+)
+
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	FlateCompression
+)
+
+var ErrRootHashMismatch = errors.New("ads: proof root does not match the hash in its header")
+
+var ErrLegacyHash = errors.New("ads: proof uses the legacy hash scheme, which is not allowed")
+
+type WriteOptions struct {
+	Registry *Registry
+	Format   Format
+
+	// Transparent holds the values written in full, besides the root.
+	Transparent map[ADS]bool
+
+	Compression Compression
+
+	// Dedup writes shared values once, as Encoder.Dedup does.
+	Dedup bool
+}
+
+type ReadOptions struct {
+	Registry *Registry
+
+	// Limits bounds the resources spent reading the proof, and is
+	// DefaultLimits if zero. Unlimited turns them off, for proofs from
+	// trusted sources only.
+	Limits    DecoderLimits
+	Unlimited bool
+
+	// AllowLegacyHash accepts proofs hashed with sha.SchemeV1. The process
+	// must have selected that scheme with sha.UseScheme to check them.
+	AllowLegacyHash bool
+}
+
+type Proof struct {
+	Fingerprint sha.Hash
+	Format      Format
+	Compression Compression
+	Dedup       bool
+	Hasher      sha.Hasher
+	Scheme      sha.Scheme
+	RootType    string
+	RootHash    sha.Hash
+
+	Root ADS
+}
+
+// WriteProof writes root and the values in options.Transparent as a proof
+// container.
+func WriteProof(w io.Writer, root ADS, options WriteOptions) error {
+	typ := reflect.TypeOf(root)
+	name, found := namesFor(options.Registry).TypeName(typ)
+	if !found {
+		return fmt.Errorf("ads: proof root type %v is not registered", typ)
+	}
+
+	transparent := make(map[ADS]bool, len(options.Transparent)+1)
+	for value := range options.Transparent {
+		transparent[value] = true
+	}
+	transparent[root] = true
+
+	header := new(bytes.Buffer)
+	e := Encoder{Writer: header}
+	header.WriteString(proofMagic)
+	e.writeLE(uint8(ProofVersion))
+	header.Write(options.Registry.Fingerprint().Bytes())
+	e.writeLE(uint8(options.Format))
+	e.writeLE(uint8(options.Compression))
+	var flags uint8
+	if options.Dedup {
+		flags |= proofDedup
+	}
+	e.writeLE(flags)
+	e.writeLE(uint8(sha.Current()))
+	e.writeLE(uint8(sha.CurrentScheme()))
+	e.WriteString(name)
+	header.Write(Hash(root).Bytes())
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	payload := w
+	var compressor *flate.Writer
+	switch options.Compression {
+	case NoCompression:
+	case FlateCompression:
+		compressor, _ = flate.NewWriter(w, flate.DefaultCompression)
+		payload = compressor
+	default:
+		return fmt.Errorf("ads: unknown compression %d", options.Compression)
+	}
+
+	buffer := GetFromPool()
+	defer ReturnToPool(buffer)
+
+	e = Encoder{
+		Writer:      buffer,
+		Transparent: transparent,
+		Format:      options.Format,
+		Registry:    options.Registry,
+		Dedup:       options.Dedup,
+	}
+	ptr := reflect.New(typ)
+	ptr.Elem().Set(reflect.ValueOf(root))
+	e.Encode(ptr.Interface())
+
+	if _, err := payload.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+	return nil
+}
+
+// limits returns the DecoderLimits to read a proof with.
+func (options ReadOptions) limits() DecoderLimits {
+	if options.Unlimited {
+		return DecoderLimits{}
+	}
+	if options.Limits == (DecoderLimits{}) {
+		return DefaultLimits
+	}
+	return options.Limits
+}
+
+// ReadProof reads a proof container written by WriteProof. It fails if the
+// proof was written under a different registry, or if its root does not
+// match the hash in its header.
+func ReadProof(r io.Reader, options ReadOptions) (*Proof, error) {
+	d := Decoder{Reader: r, Limits: options.limits()}
+
+	var magic [len(proofMagic)]byte
+	if err := d.ReadFull(magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != proofMagic {
+		return nil, &MalformedError{"not a proof"}
+	}
+
+	var version, format, compression, flags uint8
+	if err := d.readLE(&version); err != nil {
+		return nil, err
+	}
+	if version < 1 || version > ProofVersion {
+		return nil, &MalformedError{fmt.Sprintf("unsupported proof version %d", version)}
+	}
+
+	proof := new(Proof)
+	if err := d.ReadFull(proof.Fingerprint[:]); err != nil {
+		return nil, err
+	}
+
+	if err := d.readLE(&format); err != nil {
+		return nil, err
+	}
+	if err := d.readLE(&compression); err != nil {
+		return nil, err
+	}
+	proof.Format, proof.Compression = Format(format), Compression(compression)
+	if proof.Format != FixedFormat && proof.Format != CompactFormat {
+		return nil, &MalformedError{fmt.Sprintf("unknown format %d", format)}
+	}
+
+	if version >= 2 {
+		if err := d.readLE(&flags); err != nil {
+			return nil, err
+		}
+		if flags&^proofDedup != 0 {
+			return nil, &MalformedError{fmt.Sprintf("unknown flags %#x", flags)}
+		}
+	}
+	proof.Dedup = flags&proofDedup != 0
+
+	proof.Hasher = sha.SHA256
+	if version >= 3 {
+		if err := d.readLE(&proof.Hasher); err != nil {
+			return nil, err
+		}
+	}
+	if proof.Hasher != sha.Current() {
+		return nil, fmt.Errorf("ads: proof was hashed with %v, not %v", proof.Hasher, sha.Current())
+	}
+
+	proof.Scheme = sha.SchemeV1
+	if version >= 4 {
+		if err := d.readLE(&proof.Scheme); err != nil {
+			return nil, err
+		}
+	}
+	if proof.Scheme == sha.SchemeV1 && !options.AllowLegacyHash {
+		return nil, ErrLegacyHash
+	}
+	if proof.Scheme != sha.CurrentScheme() {
+		return nil, fmt.Errorf("ads: proof uses hash scheme %v, not %v", proof.Scheme, sha.CurrentScheme())
+	}
+
+	// The fingerprint covers the hasher and scheme, so check it only after
+	// giving clearer errors for those.
+	if expected := options.Registry.Fingerprint(); proof.Fingerprint != expected {
+		return nil, &FingerprintError{Expected: expected, Actual: proof.Fingerprint}
+	}
+
+	var err error
+	if proof.RootType, err = d.ReadString(); err != nil {
+		return nil, err
+	}
+	if err := d.ReadFull(proof.RootHash[:]); err != nil {
+		return nil, err
+	}
+
+	typ, found := namesFor(options.Registry).LookupType(proof.RootType)
+	if !found {
+		return nil, &UnknownTypeError{Name: proof.RootType}
+	}
+	if !typ.Implements(reflect.TypeOf((*ADS)(nil)).Elem()) {
+		return nil, &MalformedError{fmt.Sprintf("proof root type %s is not an ADS", proof.RootType)}
+	}
+
+	payload := io.Reader(r)
+	switch proof.Compression {
+	case NoCompression:
+	case FlateCompression:
+		decompressor := flate.NewReader(r)
+		defer decompressor.Close()
+		payload = decompressor
+	default:
+		return nil, &MalformedError{fmt.Sprintf("unknown compression %d", compression)}
+	}
+
+	// The payload shares the header's byte budget.
+	limits := options.limits()
+	if limits.MaxBytes > 0 {
+		limits.MaxBytes -= d.bytes
+	}
+	d = Decoder{
+		Reader:   payload,
+		Limits:   limits,
+		Format:   proof.Format,
+		Registry: options.Registry,
+		Dedup:    proof.Dedup,
+	}
+
+	ptr := reflect.New(typ)
+	if err := d.Decode(ptr.Interface()); err != nil {
+		return nil, err
+	}
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+
+	if typ.Kind() == reflect.Ptr && ptr.Elem().IsNil() {
+		return nil, &MalformedError{"proof has no root"}
+	}
+	root, ok := ptr.Elem().Interface().(ADS)
+	if !ok {
+		return nil, &MalformedError{"proof has no root"}
+	}
+	if Hash(root) != proof.RootHash {
+		return nil, ErrRootHashMismatch
+	}
+
+	proof.Root = root
+	return proof, nil
+}
@@ -0,0 +1,76 @@
+package ads
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProof(t *testing.T) {
+	n := makeTestNode()
+
+	for _, compression := range []Compression{NoCompression, FlateCompression} {
+		buffer := new(bytes.Buffer)
+		err := WriteProof(buffer, n, WriteOptions{
+			Registry:    testRegistry,
+			Format:      CompactFormat,
+			Transparent: map[ADS]bool{n.Left: true},
+			Compression: compression,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := buffer.Bytes()
+
+		proof, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: testRegistry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.RootType != "ads_test.testNode" || proof.RootHash != Hash(n) || proof.Root.(*testNode).Left.Name != "left" {
+			t.Fatalf("bad proof %+v", proof)
+		}
+
+		if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: NewRegistry()}); err == nil {
+			t.Fatalf("expected error")
+		} else if _, ok := err.(*FingerprintError); !ok {
+			t.Fatalf("expected FingerprintError, got %v", err)
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := WriteProof(buffer, n, WriteOptions{Registry: testRegistry}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	// Flip a bit in the last field of the root, its Child's hash.
+	data[len(data)-1] ^= 1
+	if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: testRegistry}); err != ErrRootHashMismatch {
+		t.Fatalf("expected ErrRootHashMismatch, got %v", err)
+	}
+}
+
+func TestProofLimits(t *testing.T) {
+	n := &testNode{Items: make([]int64, DefaultLimits.MaxLength+1)}
+	buffer := new(bytes.Buffer)
+	if err := WriteProof(buffer, n, WriteOptions{Registry: testRegistry}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	// Proofs are read under DefaultLimits unless told otherwise.
+	if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: testRegistry}); err == nil {
+		t.Errorf("expected error")
+	} else if limit, ok := err.(*LimitError); !ok || limit.Limit != "length" {
+		t.Errorf("expected LimitError on length, got %v", err)
+	}
+
+	for _, options := range []ReadOptions{
+		{Registry: testRegistry, Unlimited: true},
+		{Registry: testRegistry, Limits: DecoderLimits{MaxLength: len(n.Items)}},
+	} {
+		if proof, err := ReadProof(bytes.NewReader(data), options); err != nil {
+			t.Errorf("reading with %+v: %v", options, err)
+		} else if len(proof.Root.(*testNode).Items) != len(n.Items) {
+			t.Errorf("reading with %+v: bad proof", options)
+		}
+	}
+}
@@ -1,57 +1,310 @@
 package ads
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-var idToType map[int8]reflect.Type
-var typeToId map[reflect.Type]int8
+// A Registry assigns compact wire ids to the types and functions that may
+// appear behind interfaces in an ADS. Every type and function has a stable,
+// namespaced name such as "bitrie.Leaf"; ids are assigned in registration
+// order, so a prover and verifier must register the same names in the same
+// order.
+//
+// Names belong to a Registry, so Registries for different applications may
+// use the same name for different types. Hashing is not per Registry:
+// hashes are computed without one, name types by the one selected with
+// UseRegistry, and use the process's sha.Hasher and sha.Scheme.
+//
+// Once all types and functions are registered, a Registry may be shared by
+// Encoders and Decoders in any number of goroutines.
+type Registry struct {
+	idToType map[int8]reflect.Type
+	typeToId map[reflect.Type]int8
+	types    []string
+	typeIds  map[string]int8
 
-var idToFunc map[int8]interface{}
-var funcToId map[interface{}]int8
+	idToFunc map[int8]interface{}
+	funcToId map[uintptr]int8
+	funcs    []string
+	funcIds  map[string]int8
 
-func init() {
-	idToType = make(map[int8]reflect.Type)
-	typeToId = make(map[reflect.Type]int8)
+	// legacyIds are the ids names had in the process-global table that
+	// preceded Registries, which sha.SchemeV1 hashes by.
+	legacyIds map[string]int8
+}
+
+const maxIds = 128
 
-	idToFunc = make(map[int8]interface{})
-	funcToId = make(map[interface{}]int8)
+func NewRegistry() *Registry {
+	return &Registry{
+		idToType:  make(map[int8]reflect.Type),
+		typeToId:  make(map[reflect.Type]int8),
+		typeIds:   make(map[string]int8),
+		idToFunc:  make(map[int8]interface{}),
+		funcToId:  make(map[uintptr]int8),
+		funcIds:   make(map[string]int8),
+		legacyIds: make(map[string]int8),
+	}
 }
 
-func RegisterType(id int8, instance interface{}) {
-	typ := reflect.TypeOf(instance)
+func checkName(name string) error {
+	if name == "" || strings.TrimSpace(name) != name {
+		return fmt.Errorf("ads: invalid name %q", name)
+	}
+	return nil
+}
 
-	if _, found := idToType[id]; found {
-		panic(typ)
+// TypeName returns the name under which typ was registered.
+func (r *Registry) TypeName(typ reflect.Type) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	id, found := r.typeToId[typ]
+	if !found {
+		return "", false
 	}
+	return r.types[id], true
+}
 
-	if _, found := typeToId[typ]; found {
-		panic(typ)
+func (r *Registry) LookupType(name string) (reflect.Type, bool) {
+	if r == nil {
+		return nil, false
+	}
+	id, found := r.typeIds[name]
+	if !found {
+		return nil, false
 	}
+	return r.idToType[id], true
+}
 
-	idToType[id] = typ
-	typeToId[typ] = id
+// FuncName returns the name under which f was registered.
+func (r *Registry) FuncName(f interface{}) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	id, found := r.funcToId[reflect.ValueOf(f).Pointer()]
+	if !found {
+		return "", false
+	}
+	return r.funcs[id], true
+}
 
-	if id == FunctionId {
-		panic(typ)
+func (r *Registry) LookupFunc(name string) (interface{}, bool) {
+	if r == nil {
+		return nil, false
+	}
+	id, found := r.funcIds[name]
+	if !found {
+		return nil, false
 	}
+	return r.idToFunc[id], true
 }
 
-func RegisterFunc(id int8, f interface{}) {
+// RegisterType registers the type of instance under name. Registering the
+// same type under the same name again is a no-op.
+func (r *Registry) RegisterType(name string, instance interface{}) error {
+	typ := reflect.TypeOf(instance)
+
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if typ == nil || typ.Kind() == reflect.Func {
+		return fmt.Errorf("ads: cannot register %v as type %q", typ, name)
+	}
+
+	if id, found := r.typeToId[typ]; found {
+		if r.types[id] != name {
+			return fmt.Errorf("ads: type %v is already registered as %q, cannot register it as %q", typ, r.types[id], name)
+		}
+		return nil
+	}
+	if id, found := r.typeIds[name]; found {
+		return fmt.Errorf("ads: %q is already registered for type %v, cannot register %v", name, r.idToType[id], typ)
+	}
+	if _, found := r.funcIds[name]; found {
+		return fmt.Errorf("ads: %q is already registered for a function", name)
+	}
+	if len(r.types) == maxIds {
+		return fmt.Errorf("ads: cannot register %q: registry holds at most %d types", name, maxIds)
+	}
+
+	id := int8(len(r.types))
+	r.idToType[id] = typ
+	r.typeToId[typ] = id
+	r.typeIds[name] = id
+	r.types = append(r.types, name)
+	return nil
+}
+
+// RegisterFunc registers f under name. Registering the same function under
+// the same name again is a no-op.
+func (r *Registry) RegisterFunc(name string, f interface{}) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if f == nil || reflect.TypeOf(f).Kind() != reflect.Func {
+		return fmt.Errorf("ads: cannot register %T as function %q", f, name)
+	}
+
 	ptr := reflect.ValueOf(f).Pointer()
+	if id, found := r.funcToId[ptr]; found {
+		if r.funcs[id] != name {
+			return fmt.Errorf("ads: function %q is already registered, cannot register it as %q", r.funcs[id], name)
+		}
+		return nil
+	}
+	if _, found := r.funcIds[name]; found {
+		return fmt.Errorf("ads: %q is already registered for another function", name)
+	}
+	if _, found := r.typeIds[name]; found {
+		return fmt.Errorf("ads: %q is already registered for a type", name)
+	}
+	if len(r.funcs) == maxIds {
+		return fmt.Errorf("ads: cannot register %q: registry holds at most %d functions", name, maxIds)
+	}
+
+	id := int8(len(r.funcs))
+	r.idToFunc[id] = f
+	r.funcToId[ptr] = id
+	r.funcIds[name] = id
+	r.funcs = append(r.funcs, name)
+	return nil
+}
 
-	if _, found := idToFunc[id]; found {
-		panic(f)
+// FuncId returns the wire id of f. A nil Registry has no ids.
+func (r *Registry) FuncId(f interface{}) (int8, bool) {
+	if r == nil {
+		return 0, false
 	}
+	id, found := r.funcToId[reflect.ValueOf(f).Pointer()]
+	return id, found
+}
+
+// SetLegacyId records the id the type or function registered as name had
+// before Registries, when ids were assigned by hand in one process-global
+// table. Under sha.SchemeV1, hashes tag interface values with these ids, or
+// with Registry ids for names without one, so that they match the hashes
+// computed then.
+func (r *Registry) SetLegacyId(name string, id int8) error {
+	_, isType := r.typeIds[name]
+	_, isFunc := r.funcIds[name]
+	if !isType && !isFunc {
+		return fmt.Errorf("ads: cannot set the legacy id of unregistered %q", name)
+	}
+	if id < 0 {
+		return fmt.Errorf("ads: bad legacy id %d for %q", id, name)
+	}
+	r.legacyIds[name] = id
+	return nil
+}
+
+// typeId returns the id to tag typ with: its legacy id, if legacy is set
+// and it has one, or else its Registry id.
+func (r *Registry) typeId(typ reflect.Type, legacy bool) (int8, bool) {
+	id, found := r.typeToId[typ]
+	if found && legacy {
+		if legacyId, found := r.legacyIds[r.types[id]]; found {
+			return legacyId, true
+		}
+	}
+	return id, found
+}
+
+func (r *Registry) funcId(ptr uintptr, legacy bool) (int8, bool) {
+	id, found := r.funcToId[ptr]
+	if found && legacy {
+		if legacyId, found := r.legacyIds[r.funcs[id]]; found {
+			return legacyId, true
+		}
+	}
+	return id, found
+}
+
+var hashRegistry struct {
+	sync.Mutex
+	registry atomic.Value
+	// used is set once anything has been hashed by name or id.
+	used int32
+}
+
+// UseRegistry selects the Registry whose names tag interface values in
+// hashes, in Encoders and Decoders without a Registry, in debug JSON and
+// in ads.Diff. Like sha.Use, it must be called once per process, before
+// anything is hashed: values cache their hashes, so changing it later
+// panics.
+func UseRegistry(r *Registry) {
+	hashRegistry.Lock()
+	defer hashRegistry.Unlock()
 
-	if _, found := funcToId[ptr]; found {
-		panic(f)
+	if current := HashRegistry(); atomic.LoadInt32(&hashRegistry.used) != 0 && current != r {
+		panic("ads: UseRegistry called after hashing started")
 	}
+	hashRegistry.registry.Store(r)
+}
+
+// HashRegistry returns the Registry selected with UseRegistry, or nil.
+func HashRegistry() *Registry {
+	r, _ := hashRegistry.registry.Load().(*Registry)
+	return r
+}
 
-	idToFunc[id] = f
-	funcToId[ptr] = id
+// hashingRegistry returns the Registry to hash by, and keeps it from
+// changing from then on.
+func hashingRegistry() *Registry {
+	if atomic.LoadInt32(&hashRegistry.used) == 0 {
+		atomic.StoreInt32(&hashRegistry.used, 1)
+	}
+	return HashRegistry()
+}
+
+// namesFor returns r, or, if r is nil, the Registry selected with
+// UseRegistry.
+func namesFor(r *Registry) *Registry {
+	if r != nil {
+		return r
+	}
+	return HashRegistry()
+}
+
+// A Namespace registers names prefixed with the name of a package. It
+// remembers the first error, so a package can register all its types and
+// functions and check once.
+type Namespace struct {
+	registry *Registry
+	prefix   string
+	err      error
+}
+
+func (r *Registry) Namespace(prefix string) *Namespace {
+	return &Namespace{
+		registry: r,
+		prefix:   prefix,
+	}
+}
+
+func (n *Namespace) RegisterType(name string, instance interface{}) {
+	if n.err == nil {
+		n.err = n.registry.RegisterType(n.prefix+"."+name, instance)
+	}
+}
+
+func (n *Namespace) RegisterFunc(name string, f interface{}) {
+	if n.err == nil {
+		n.err = n.registry.RegisterFunc(n.prefix+"."+name, f)
+	}
+}
+
+// SetLegacyId sets the legacy id of the name registered in n.
+func (n *Namespace) SetLegacyId(name string, id int8) {
+	if n.err == nil {
+		n.err = n.registry.SetLegacyId(n.prefix+"."+name, id)
+	}
 }
 
-func GetFuncId(f interface{}) int8 {
-	return funcToId[reflect.ValueOf(f).Pointer()]
+func (n *Namespace) Err() error {
+	return n.err
 }
@@ -0,0 +1,68 @@
+package ads
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.RegisterType("ads_test.testNode", &testNode{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterType("ads_test.testNode", &testNode{}); err != nil {
+		t.Fatalf("re-registering should be a no-op: %v", err)
+	}
+	if err := r.RegisterType("ads_test.other", &testNode{}); err == nil {
+		t.Fatalf("expected error registering a type under two names")
+	}
+	if err := r.RegisterType("ads_test.testNode", &testMap{}); err == nil {
+		t.Fatalf("expected error registering two types under one name")
+	}
+
+	n := r.Namespace("ads_test")
+	n.RegisterType("testMap", &testMap{})
+	n.RegisterType("testMap", int64(0))
+	n.RegisterType("later", int32(0))
+	if n.Err() == nil {
+		t.Fatalf("expected namespace error")
+	}
+	if _, found := r.LookupType("ads_test.later"); found {
+		t.Fatalf("registered after an error")
+	}
+
+	if r.typeToId[reflect.TypeOf(&testMap{})] != 1 {
+		t.Fatalf("ids not assigned in order")
+	}
+
+	// Names are per registry.
+	other := NewRegistry()
+	if err := other.RegisterType("ads_test.testNode", &testMap{}); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := other.LookupType("ads_test.testNode"); typ != reflect.TypeOf(&testMap{}) {
+		t.Fatalf("names shared between registries")
+	}
+	if typ, _ := r.LookupType("ads_test.testNode"); typ != reflect.TypeOf(&testNode{}) {
+		t.Fatalf("names shared between registries")
+	}
+
+	// The same value encodes with registry ids, but hashes by name.
+	node := &testNode{Name: "x"}
+	var value interface{} = node
+	for _, registry := range []*Registry{testRegistry, r, nil} {
+		buffer := new(bytes.Buffer)
+		e := Encoder{Writer: buffer, Transparent: map[ADS]bool{node: true}, Registry: registry}
+		e.Encode(&value)
+
+		var decoded interface{}
+		d := Decoder{Reader: bytes.NewReader(buffer.Bytes()), Registry: registry}
+		if err := d.Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.(*testNode).Name != "x" {
+			t.Fatalf("bad decode %v", decoded)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package ads
 import (
 	"certcomp/sha"
 	"fmt"
+	"sync/atomic"
 )
 
 // authenticated data structure
@@ -22,6 +23,10 @@ type Info struct {
 	Prev, Next *Info
 	Value      ADS
 	Token      int64
+
+	// Size and State are kept by pagers for their eviction policies.
+	Size  int64
+	State int8
 }
 
 func (i *Info) String() string {
@@ -31,12 +36,20 @@ func (i *Info) String() string {
 // For convenient struct initializaton, the default Base is marked as
 // having data but no cached hash.
 type Base struct {
-	cachedHash    sha.Hash
-	hasCachedHash bool
-	isOpaque      bool
-	info          Info
+	cachedHash sha.Hash
+	hashState  int32
+	isOpaque   bool
+	info       Info
 }
 
+// The cached hash is written once, by whichever goroutine claims it first;
+// readers only see it once it is complete.
+const (
+	hashUnset int32 = iota
+	hashWriting
+	hashSet
+)
+
 func (bv *Base) AssertTransparent() {
 	if bv.isOpaque {
 		panic(bv)
@@ -51,13 +64,29 @@ func (bv *Base) MakeTransparent() {
 	bv.isOpaque = false
 }
 
+// SetCachedHash caches hash, replacing any hash cached before, as when a
+// value is decoded over. It must not race with other uses of the value.
 func (bv *Base) SetCachedHash(hash sha.Hash) {
+	atomic.StoreInt32(&bv.hashState, hashWriting)
 	bv.cachedHash = hash
-	bv.hasCachedHash = true
+	atomic.StoreInt32(&bv.hashState, hashSet)
+}
+
+// cacheHash caches hash unless a hash is already cached, for Hash. Hashes
+// are deterministic, so concurrent callers all try to set the same value.
+func (bv *Base) cacheHash(hash sha.Hash) {
+	if atomic.CompareAndSwapInt32(&bv.hashState, hashUnset, hashWriting) {
+		bv.cachedHash = hash
+		atomic.StoreInt32(&bv.hashState, hashSet)
+	}
+}
+
+type hashCacher interface {
+	cacheHash(sha.Hash)
 }
 
 func (bv *Base) CachedHash() *sha.Hash {
-	if bv.hasCachedHash {
+	if atomic.LoadInt32(&bv.hashState) == hashSet {
 		return &bv.cachedHash
 	} else {
 		return nil
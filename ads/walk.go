@@ -0,0 +1,149 @@
+package ads
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// SkipChildren is returned by a Visitor's Pre to have Walk skip the
+// children of the value being visited. Its Post is still called.
+var SkipChildren = errors.New("skip children")
+
+// An OpaquePolicy says what Walk does on reaching an opaque value.
+type OpaquePolicy int
+
+const (
+	// StopAtOpaque visits opaque values but not their children, unless
+	// Pre makes them transparent itself.
+	StopAtOpaque OpaquePolicy = iota
+	// LoadOpaque makes opaque values transparent with the Loader before
+	// visiting them, and fails with an OpaqueError if it cannot.
+	LoadOpaque
+	// ErrorOnOpaque fails with an OpaqueError.
+	ErrorOnOpaque
+)
+
+// A Visit is a value reached by Walk, along with where it was found.
+type Visit struct {
+	Value  ADS
+	Parent *Visit
+	// Field locates Value in Parent.Value, such as "Left" or
+	// "Transactions[3]". It is empty for the root.
+	Field string
+	Depth int
+}
+
+// Path returns the fields leading from the root to v, as in Difference.
+func (v *Visit) Path() string {
+	if v.Parent == nil {
+		return ""
+	}
+	return join(v.Parent.Path(), v.Field)
+}
+
+// A Visitor holds the callbacks for Walk. Pre is called on a value before
+// its children and Post after them; either may be nil. An error other than
+// SkipChildren stops the walk and is returned by Walk.
+type Visitor struct {
+	Pre, Post func(v *Visit) error
+	Opaque    OpaquePolicy
+}
+
+// Walk visits root and every ADS value below it, depth-first, with children
+// in the order CollectChildren returns them. loader is only used under
+// LoadOpaque.
+func Walk(root ADS, visitor Visitor, loader Loader) error {
+	return visitor.walk(&Visit{Value: root}, loader)
+}
+
+func (visitor *Visitor) walk(v *Visit, loader Loader) error {
+	if v.Value.IsOpaque() {
+		switch visitor.Opaque {
+		case LoadOpaque:
+			if loader != nil {
+				loader.Use(v.Value)
+			}
+			if v.Value.IsOpaque() {
+				return &OpaqueError{Path: v.Path(), Hash: Hash(v.Value)}
+			}
+		case ErrorOnOpaque:
+			return &OpaqueError{Path: v.Path(), Hash: Hash(v.Value)}
+		}
+	}
+
+	skip := false
+	if visitor.Pre != nil {
+		if err := visitor.Pre(v); err == SkipChildren {
+			skip = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !skip && !v.Value.IsOpaque() {
+		err := walkChildren(reflect.ValueOf(v.Value).Elem(), "", func(field string, child ADS) error {
+			return visitor.walk(&Visit{Value: child, Parent: v, Field: field, Depth: v.Depth + 1}, loader)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if visitor.Post != nil {
+		if err := visitor.Post(v); err != SkipChildren {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkChildren calls f on the ADS values in v, as collectChildren finds
+// them, along with their fields relative to field.
+func walkChildren(v reflect.Value, field string, f func(field string, child ADS) error) error {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkChildren(v.Index(i), field+"["+strconv.Itoa(i)+"]", f); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, key := range sortedMapKeys(v) {
+			if err := walkChildren(v.MapIndex(key.value), fmt.Sprintf("%s[%v]", field, key.value), f); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if value, ok := v.Interface().(ADS); ok {
+			return f(field, value)
+		}
+		return walkChildren(v.Elem(), field, f)
+
+	case reflect.Interface:
+		if v.IsNil() || v.Elem().Kind() == reflect.Func {
+			return nil
+		}
+		return walkChildren(v.Elem(), field, f)
+
+	case reflect.Struct:
+		typ := v.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			sub := typ.Field(i)
+			if sub.Type == baseValueType && sub.Anonymous {
+				continue
+			}
+			if err := walkChildren(v.Field(i), join(field, sub.Name), f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package ads
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	n := makeTestNode()
+	n.Left.Left = &testNode{Name: "leftleft"}
+	n.Child.(*testNode).MakeOpaque()
+
+	var order []string
+	visitor := Visitor{
+		Pre: func(v *Visit) error {
+			order = append(order, fmt.Sprintf("pre %s %d", v.Path(), v.Depth))
+			if v.Field == "Left" && v.Depth == 2 {
+				return SkipChildren
+			}
+			return nil
+		},
+		Post: func(v *Visit) error {
+			order = append(order, "post "+v.Path())
+			return nil
+		},
+	}
+	if err := Walk(n, visitor, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"pre  0", "pre Left 1", "pre Left.Left 2", "post Left.Left", "post Left",
+		"pre Child 1", "post Child", "post ",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("unexpected order %q", order)
+	}
+
+	visitor.Opaque = ErrorOnOpaque
+	if err, ok := Walk(n, visitor, nil).(*OpaqueError); !ok || err.Path != "Child" {
+		t.Errorf("expected OpaqueError at Child, got %v", err)
+	}
+
+	order = nil
+	visitor.Opaque = LoadOpaque
+	if err := Walk(n, visitor, transparentLoader{}); err != nil {
+		t.Fatal(err)
+	}
+	if n.Child.(*testNode).IsOpaque() || len(order) != 8 {
+		t.Errorf("opaque child was not loaded: %q", order)
+	}
+}
@@ -4,67 +4,114 @@ import (
 	"bytes"
 	"certcomp/sha"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"reflect"
+	"sync"
 )
 
 type Hashable interface {
 	ComputeHash() sha.Hash
 }
 
-var pool []*bytes.Buffer
+var pool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
 
+// GetFromPool returns an empty buffer. It is safe for concurrent use.
 func GetFromPool() *bytes.Buffer {
-	n := len(pool)
-	if n > 0 {
-		r := pool[n-1]
-		pool = pool[:n-1]
-
-		r.Reset()
-		return r
-	} else {
-		return new(bytes.Buffer)
-	}
+	r := pool.Get().(*bytes.Buffer)
+	r.Reset()
+	return r
 }
 
 func ReturnToPool(b *bytes.Buffer) {
-	pool = append(pool, b)
+	pool.Put(b)
 }
 
+// Hash returns the hash of v, caching it in v. It is safe to hash values
+// that share children from several goroutines, as long as none of them
+// modifies the values.
 func Hash(v ADS) sha.Hash {
 	if h := v.CachedHash(); h != nil {
 		return *h
 	}
 
-	hashable, ok := v.(Hashable)
-
-	var hash sha.Hash
-	if ok {
-		hash = hashable.ComputeHash()
+	hash := ComputeHash(v)
+	if cacher, ok := v.(hashCacher); ok {
+		cacher.cacheHash(hash)
 	} else {
-		buffer := GetFromPool()
-		defer ReturnToPool(buffer)
+		v.SetCachedHash(hash)
+	}
+	return hash
+}
 
-		e := Encoder{
-			Writer:      buffer,
-			Transparent: map[ADS]bool{v: true},
-		}
-		e.Encode(&v)
-		hash = sha.Sum(buffer.Bytes())
+// ComputeHash hashes v from its contents, ignoring any hash cached on v
+// itself, but not those cached on its children.
+func ComputeHash(v ADS) sha.Hash {
+	if hashable, ok := v.(Hashable); ok {
+		return hashable.ComputeHash()
 	}
+	return EncodedHash(v)
+}
 
-	v.SetCachedHash(hash)
-	return hash
+// EncodedHash hashes the FixedFormat encoding of v, ignoring any cached
+// hash or ComputeHash method on v itself.
+func EncodedHash(v ADS) sha.Hash {
+	buffer := GetFromPool()
+	defer ReturnToPool(buffer)
+
+	e := Encoder{
+		Writer:      buffer,
+		Transparent: map[ADS]bool{v: true},
+		hashing:     v,
+	}
+	// SchemeV1 tags interface values by id, as hashes were computed before
+	// names; later schemes by name.
+	if sha.CurrentScheme() == sha.SchemeV1 {
+		e.Registry = hashingRegistry()
+		e.legacy = true
+	} else {
+		hashingRegistry()
+	}
+	e.Encode(&v)
+	return encodedSum(buffer.Bytes())
+}
+
+// encodedSum hashes the encoding of a value. Encodings tag the values
+// behind interfaces with their types, so one domain serves all types.
+func encodedSum(data []byte) sha.Hash {
+	return sha.DomainSum("ads", data)
 }
 
 type Encodeable interface {
 	Encode(*Encoder)
-	Decode(*Decoder)
+	Decode(*Decoder) error
 }
 
 type Encoder struct {
 	io.Writer
 	Transparent map[ADS]bool
+	Format      Format
+
+	// Registry assigns compact ids to the types and functions behind
+	// interfaces. Without one, they are written by name, as for hashing.
+	Registry *Registry
+
+	// Dedup writes each transparent value once; later occurrences refer
+	// back to it by the order in which it was first written.
+	Dedup bool
+	refs  map[ADS]int
+
+	// reflective is encoded without its Encodeable methods, for SelfCheck.
+	reflective ADS
+	// hashing is the value being hashed; SelfCheck hashes it itself, so
+	// it is not checked again.
+	hashing ADS
+	// legacy writes the legacy ids of the Registry, for SchemeV1 hashes.
+	legacy bool
 }
 
 const FunctionId = -127
@@ -79,12 +126,28 @@ func (e *Encoder) encodePtr(v reflect.Value) {
 			e.Write([]byte{0})
 			e.Write(Hash(value).Bytes())
 			return
+		} else if idx, found := e.refs[value]; found && e.Dedup {
+			e.Write([]byte{2})
+			e.WriteUint(uint64(idx), 4)
+			return
 		} else {
+			if e.Dedup {
+				if e.refs == nil {
+					e.refs = make(map[ADS]int)
+				}
+				e.refs[value] = len(e.refs)
+			}
 			e.Write([]byte{1})
 		}
 	}
 
-	if encodeable, ok := v.Interface().(Encodeable); ok {
+	if encodeable, ok := v.Interface().(Encodeable); ok && v.Interface() != e.reflective {
+		if CheckGenerated && isGenerated(v.Type()) && v.Interface() != e.hashing {
+			if err := SelfCheck(v.Interface().(ADS)); err != nil {
+				panic(err)
+			}
+		}
+
 		encodeable.Encode(e)
 		return
 	}
@@ -106,40 +169,48 @@ func (e *Encoder) encode(v reflect.Value) {
 	}
 
 	switch v.Kind() {
-	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
-
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Float32, reflect.Float64:
 		e.writeLE(v.Interface())
 
+	case reflect.Int16, reflect.Int32, reflect.Int64:
+		e.WriteInt(v.Int(), int(v.Type().Size()))
+
+	case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.WriteUint(v.Uint(), int(v.Type().Size()))
+
 	case reflect.String:
-		e.writeLE(int32(v.Len()))
-		e.Write([]byte(v.String()))
+		e.WriteString(v.String())
 
 	case reflect.Slice:
-		e.writeLE(int32(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.WriteBytes(v.Bytes())
+			break
+		}
+
+		e.WriteLength(v.Len())
 		fallthrough
 	case reflect.Array:
 		for i := 0; i < v.Len(); i++ {
 			e.encode(v.Index(i))
 		}
 
+	case reflect.Map:
+		keys := sortedMapKeys(v)
+		e.WriteLength(len(keys))
+		for _, key := range keys {
+			e.encode(key.value)
+			e.encode(v.MapIndex(key.value))
+		}
+
 	case reflect.Ptr:
 		e.encodePtr(v)
 
 	case reflect.Interface:
 		if v.Elem().Kind() == reflect.Func {
 			e.writeLE(int8(FunctionId))
-			id, found := funcToId[v.Elem().Pointer()]
-			if !found {
-				panic(v.Elem())
-			}
-			e.writeLE(id)
+			e.writeFunc(v.Elem())
 		} else {
-			id, found := typeToId[v.Elem().Type()]
-			if !found {
-				panic(v.Elem().Type())
-			}
-			e.Write([]byte{byte(id)})
+			e.writeType(v.Elem().Type())
 			e.encode(v.Elem())
 		}
 
@@ -154,11 +225,56 @@ func (e *Encoder) encode(v reflect.Value) {
 			e.encode(v.Field(i))
 		}
 
-	default: // Map, Func?
+	default: // Func?
 		panic(v)
 	}
 }
 
+// writeType writes the tag of an interface value of type typ: its Registry
+// id or, without a Registry, a 0 followed by its name in the Registry
+// selected with UseRegistry.
+func (e *Encoder) writeType(typ reflect.Type) {
+	if e.Registry == nil {
+		if e.legacy {
+			panic("ads: SchemeV1 hashes need a Registry; see UseRegistry")
+		}
+		name, found := HashRegistry().TypeName(typ)
+		if !found {
+			panic(typ)
+		}
+		e.Write([]byte{0})
+		e.WriteString(name)
+		return
+	}
+
+	id, found := e.Registry.typeId(typ, e.legacy)
+	if !found {
+		panic(typ)
+	}
+	e.Write([]byte{byte(id)})
+}
+
+// writeFunc writes what follows the FunctionId marker of f, like writeType.
+func (e *Encoder) writeFunc(f reflect.Value) {
+	if e.Registry == nil {
+		if e.legacy {
+			panic("ads: SchemeV1 hashes need a Registry; see UseRegistry")
+		}
+		name, found := HashRegistry().FuncName(f.Interface())
+		if !found {
+			panic(f)
+		}
+		e.WriteString(name)
+		return
+	}
+
+	id, found := e.Registry.funcId(f.Pointer(), e.legacy)
+	if !found {
+		panic(f)
+	}
+	e.writeLE(id)
+}
+
 func (e *Encoder) Encode(ptrToValue interface{}) {
 	v := reflect.ValueOf(ptrToValue)
 	if v.Kind() != reflect.Ptr {
@@ -168,99 +284,343 @@ func (e *Encoder) Encode(ptrToValue interface{}) {
 	e.encode(v.Elem())
 }
 
+// DecoderLimits bounds the resources a Decoder may spend on its input, so
+// that proofs from untrusted sources cannot exhaust memory or stack. Zero
+// fields are unlimited.
+type DecoderLimits struct {
+	MaxBytes  int64 // total bytes read
+	MaxLength int   // elements in a single slice, or bytes in a string
+	MaxDepth  int   // nesting of pointers and interfaces
+	MaxNodes  int   // ADS values, opaque or not
+}
+
+var DefaultLimits = DecoderLimits{
+	MaxBytes:  64 << 20,
+	MaxLength: 1 << 20,
+	MaxDepth:  512,
+	MaxNodes:  1 << 20,
+}
+
 type Decoder struct {
 	io.Reader
+	Limits   DecoderLimits
+	Format   Format
+	Registry *Registry
+
+	// Dedup accepts back-references written by an Encoder with Dedup set.
+	Dedup bool
+	refs  []ADS
+
+	bytes int64
+	depth int
+	nodes int
+}
+
+func (d *Decoder) Read(buffer []byte) (int, error) {
+	if d.Limits.MaxBytes > 0 {
+		remaining := d.Limits.MaxBytes - d.bytes
+		if remaining <= 0 {
+			return 0, &LimitError{"bytes", d.Limits.MaxBytes}
+		}
+		if int64(len(buffer)) > remaining {
+			buffer = buffer[:remaining]
+		}
+	}
+
+	n, err := d.Reader.Read(buffer)
+	d.bytes += int64(n)
+	return n, err
 }
 
 var baseValueType = reflect.TypeOf(Base{})
 
-func (d *Decoder) readLE(value interface{}) {
-	binary.Read(d, binary.LittleEndian, value)
+func (d *Decoder) readLE(value interface{}) error {
+	return ReadError(binary.Read(d, binary.LittleEndian, value))
+}
+
+// ReadFull reads exactly len(buffer) bytes, returning ErrTruncated if the
+// input ends early.
+func (d *Decoder) ReadFull(buffer []byte) error {
+	_, err := io.ReadFull(d, buffer)
+	return ReadError(err)
 }
 
-func (d *Decoder) decodePtr(v reflect.Value) {
+func (d *Decoder) readMarker() (bool, error) {
+	var marker int8
+	if err := d.readLE(&marker); err != nil {
+		return false, err
+	}
+
+	switch marker {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, &MalformedError{fmt.Sprintf("bad marker %d", marker)}
+	}
+}
+
+// readType resolves the type tag that starts an interface value, either a
+// Registry id or, without a Registry, a 0 followed by the type's name in the
+// Registry selected with UseRegistry.
+func (d *Decoder) readType(id int8) (reflect.Type, error) {
+	if d.Registry != nil {
+		typ, found := d.Registry.idToType[id]
+		if !found {
+			return nil, &UnknownTypeError{Id: id}
+		}
+		return typ, nil
+	}
+
+	if id != 0 {
+		return nil, &MalformedError{fmt.Sprintf("bad type marker %d", id)}
+	}
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	typ, found := HashRegistry().LookupType(name)
+	if !found {
+		return nil, &UnknownTypeError{Name: name}
+	}
+	return typ, nil
+}
+
+// readFunc resolves the function following a FunctionId marker.
+func (d *Decoder) readFunc() (interface{}, error) {
+	if d.Registry != nil {
+		var id int8
+		if err := d.readLE(&id); err != nil {
+			return nil, err
+		}
+		f, found := d.Registry.idToFunc[id]
+		if !found {
+			return nil, &UnknownFuncError{Id: id}
+		}
+		return f, nil
+	}
+
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	f, found := HashRegistry().LookupFunc(name)
+	if !found {
+		return nil, &UnknownFuncError{Name: name}
+	}
+	return f, nil
+}
+
+func (d *Decoder) decodePtr(v reflect.Value) error {
 	if value, ok := v.Interface().(ADS); ok {
-		var typ int8
-		d.readLE(&typ)
+		d.nodes++
+		if d.Limits.MaxNodes > 0 && d.nodes > d.Limits.MaxNodes {
+			return &LimitError{"nodes", int64(d.Limits.MaxNodes)}
+		}
 
-		if typ == 0 {
-			var bytes [32]byte
-			d.Read(bytes[:])
-			value.SetCachedHash(sha.Hash(bytes))
+		var marker int8
+		if err := d.readLE(&marker); err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0:
+			var hash sha.Hash
+			if err := d.ReadFull(hash[:]); err != nil {
+				return err
+			}
+			value.SetCachedHash(hash)
 			value.MakeOpaque()
-			return
+			return nil
+
+		case marker == 1 && d.Dedup:
+			// Unfinished values stay nil, so that a reference to one of
+			// its ancestors cannot make a value contain itself.
+			idx := len(d.refs)
+			d.refs = append(d.refs, nil)
+			if err := d.decodeValue(v); err != nil {
+				return err
+			}
+			d.refs[idx] = value
+			return nil
+
+		case marker == 1:
+
+		case marker == 2 && d.Dedup:
+			return d.decodeRef(v)
+
+		default:
+			return &MalformedError{fmt.Sprintf("bad marker %d", marker)}
 		}
 	}
 
+	return d.decodeValue(v)
+}
+
+func (d *Decoder) decodeValue(v reflect.Value) error {
 	if encodeable, ok := v.Interface().(Encodeable); ok {
-		encodeable.Decode(d)
-		return
+		return encodeable.Decode(d)
+	}
+
+	return d.decode(v.Elem())
+}
+
+func (d *Decoder) decodeRef(v reflect.Value) error {
+	idx, err := d.ReadUint(4)
+	if err != nil {
+		return err
+	}
+	if idx >= uint64(len(d.refs)) || d.refs[idx] == nil {
+		return &MalformedError{fmt.Sprintf("bad back-reference %d", idx)}
 	}
 
-	d.decode(v.Elem())
+	ref := reflect.ValueOf(d.refs[idx])
+	if ref.Type() != v.Type() {
+		return &MalformedError{fmt.Sprintf("back-reference to %v, expected %v", ref.Type(), v.Type())}
+	}
+	if !v.CanSet() {
+		return &MalformedError{"back-reference into a preset value"}
+	}
+	v.Set(ref)
+	return nil
 }
 
-func (d *Decoder) decode(v reflect.Value) {
+func (d *Decoder) decode(v reflect.Value) error {
 	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-		var typ int8
-		d.readLE(&typ)
-		if typ == 0 {
+		d.depth++
+		defer func() { d.depth-- }()
+		if d.Limits.MaxDepth > 0 && d.depth > d.Limits.MaxDepth {
+			return &LimitError{"depth", int64(d.Limits.MaxDepth)}
+		}
+
+		present, err := d.readMarker()
+		if err != nil {
+			return err
+		}
+		if !present {
+			if !v.CanSet() {
+				return &MalformedError{"nil in place of a preset value"}
+			}
 			v.Set(reflect.Zero(v.Type()))
-			return
+			return nil
 		}
 	}
 
 	switch v.Kind() {
-	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Float32, reflect.Float64:
+		return d.readLE(v.Addr().Interface())
+
+	case reflect.Int16, reflect.Int32, reflect.Int64:
+		value, err := d.ReadInt(int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetInt(value)
 
-		d.readLE(v.Addr().Interface())
+	case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value, err := d.ReadUint(int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetUint(value)
 
 	case reflect.String:
-		var length int32
-		d.readLE(&length)
-		buffer := make([]byte, length)
-		v.SetString(string(buffer))
+		value, err := d.ReadString()
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
 
 	case reflect.Slice:
-		var length int32
-		d.readLE(&length)
-		v.Set(reflect.MakeSlice(v.Type(), int(length), int(length)))
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), length, length))
 		fallthrough
 	case reflect.Array:
 		for i := 0; i < v.Len(); i++ {
-			d.decode(v.Index(i))
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
 		}
 
+	case reflect.Map:
+		typ := v.Type()
+		if err := checkMapKey(typ.Key()); err != nil {
+			return err
+		}
+
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+
+		m := reflect.MakeMap(typ)
+		var previous []byte
+		for i := 0; i < length; i++ {
+			key := reflect.New(typ.Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+
+			encoded := encodeMapKey(key)
+			if i > 0 && bytes.Compare(previous, encoded) >= 0 {
+				return &MalformedError{"map keys not in canonical order"}
+			}
+			previous = encoded
+
+			value := reflect.New(typ.Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+
 	case reflect.Ptr:
 		if v.IsNil() {
 			v.Set(reflect.New(v.Type().Elem()))
 		}
-		d.decodePtr(v)
+		return d.decodePtr(v)
 
 	case reflect.Interface:
 		var id int8
-		d.readLE(&id)
+		if err := d.readLE(&id); err != nil {
+			return err
+		}
 
 		if id == FunctionId {
-			d.readLE(&id)
-			f, found := idToFunc[id]
-			if !found {
-				panic(id)
+			f, err := d.readFunc()
+			if err != nil {
+				return err
 			}
-			v.Set(reflect.ValueOf(f))
+			fv := reflect.ValueOf(f)
+			if !fv.Type().AssignableTo(v.Type()) {
+				return &MalformedError{fmt.Sprintf("func %v does not fit in %v", fv.Type(), v.Type())}
+			}
+			v.Set(fv)
 
 		} else {
-			typ, found := idToType[id]
-			if !found {
-				panic(id)
+			typ, err := d.readType(id)
+			if err != nil {
+				return err
+			}
+			if !typ.AssignableTo(v.Type()) {
+				return &MalformedError{fmt.Sprintf("%v does not fit in %v", typ, v.Type())}
 			}
 
 			if v.Elem().IsValid() {
-				d.decode(v.Elem())
+				if v.Elem().Type() != typ {
+					return &MalformedError{fmt.Sprintf("expected %v, got %v", v.Elem().Type(), typ)}
+				}
+				return d.decode(v.Elem())
 			} else {
 				actual := reflect.New(typ)
-				d.decode(actual.Elem())
+				if err := d.decode(actual.Elem()); err != nil {
+					return err
+				}
 				v.Set(actual.Elem())
 			}
 		}
@@ -273,22 +633,38 @@ func (d *Decoder) decode(v reflect.Value) {
 				continue
 			}
 
-			d.decode(v.Field(i))
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
 		}
 
-	default: // Map, Func?
-		panic(v)
-
+	default: // Func?
+		return fmt.Errorf("ads: cannot decode %v", v.Type())
 	}
+
+	return nil
 }
 
-func (d *Decoder) Decode(ptrToValue interface{}) {
+func (d *Decoder) Decode(ptrToValue interface{}) error {
 	v := reflect.ValueOf(ptrToValue)
 	if v.Kind() != reflect.Ptr {
-		panic(v)
+		return fmt.Errorf("ads: cannot decode into non-pointer %v", v.Type())
 	}
 
-	d.decode(v.Elem())
+	return d.decode(v.Elem())
+}
+
+// Finish checks that the input has been consumed completely.
+func (d *Decoder) Finish() error {
+	var buffer [1]byte
+	n, err := d.Reader.Read(buffer[:])
+	if n > 0 {
+		return ErrTrailingBytes
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
 }
 
 func Equals(a, b ADS) bool {
@@ -327,6 +703,11 @@ func collectChildren(v reflect.Value, children *[]ADS) {
 			collectChildren(v.Index(i), children)
 		}
 
+	case reflect.Map:
+		for _, key := range sortedMapKeys(v) {
+			collectChildren(v.MapIndex(key.value), children)
+		}
+
 	case reflect.Ptr:
 		collectChildrenPtr(v, children)
 
@@ -334,9 +715,6 @@ func collectChildren(v reflect.Value, children *[]ADS) {
 		if v.Elem().Kind() == reflect.Func {
 			return
 		} else {
-			if _, found := typeToId[v.Elem().Type()]; !found {
-				panic(v.Elem().Type())
-			}
 			collectChildren(v.Elem(), children)
 		}
 
@@ -351,7 +729,7 @@ func collectChildren(v reflect.Value, children *[]ADS) {
 			collectChildren(v.Field(i), children)
 		}
 
-	default: // Map, Func?
+	default: // Func?
 		panic(v)
 	}
 }
@@ -0,0 +1,456 @@
+package ads
+
+import (
+	"bytes"
+	"certcomp/sha"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+type testNode struct {
+	Base
+
+	Name  string
+	Value int32
+	Items []int64
+	Left  *testNode
+	Child interface{}
+}
+
+var testRegistry = NewRegistry()
+
+func init() {
+	testRegistry.RegisterType("ads_test.testNode", &testNode{})
+	testRegistry.RegisterType("int64", int64(0))
+	UseRegistry(testRegistry)
+}
+
+func encodeTestNode(n *testNode) []byte {
+	buffer := new(bytes.Buffer)
+	e := Encoder{
+		Writer:      buffer,
+		Transparent: map[ADS]bool{n: true, n.Left: true},
+	}
+	e.Encode(&n)
+	return buffer.Bytes()
+}
+
+func makeTestNode() *testNode {
+	return &testNode{
+		Name:  "root",
+		Value: 7,
+		Items: []int64{1, 2, 3},
+		Left:  &testNode{Name: "left", Child: int64(5)},
+		Child: &testNode{Name: "opaque"},
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	n := makeTestNode()
+	data := encodeTestNode(n)
+
+	var decoded *testNode
+	d := Decoder{Reader: bytes.NewReader(data)}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Name != "root" || decoded.Left.Name != "left" || decoded.Left.Child != int64(5) {
+		t.Fatalf("bad decode: %+v", decoded)
+	}
+	if !decoded.Child.(*testNode).IsOpaque() {
+		t.Fatalf("expected opaque child")
+	}
+	if Hash(decoded) != Hash(n) {
+		t.Fatalf("hash mismatch")
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data := encodeTestNode(makeTestNode())
+
+	for i := 0; i < len(data); i++ {
+		var decoded *testNode
+		d := Decoder{Reader: bytes.NewReader(data[:i])}
+		if err := d.Decode(&decoded); err != ErrTruncated {
+			t.Fatalf("prefix %d: expected ErrTruncated, got %v", i, err)
+		}
+	}
+}
+
+func TestDecodeTrailing(t *testing.T) {
+	data := append(encodeTestNode(makeTestNode()), 0)
+
+	var decoded *testNode
+	d := Decoder{Reader: bytes.NewReader(data)}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finish(); err != ErrTrailingBytes {
+		t.Fatalf("expected ErrTrailingBytes, got %v", err)
+	}
+}
+
+func TestDecodeUnknownIds(t *testing.T) {
+	var value interface{}
+
+	d := Decoder{Reader: bytes.NewReader([]byte{1, 99}), Registry: testRegistry}
+	if err := d.Decode(&value); err == nil {
+		t.Fatalf("expected error")
+	} else if e, ok := err.(*UnknownTypeError); !ok || e.Id != 99 {
+		t.Fatalf("expected UnknownTypeError, got %v", err)
+	}
+
+	d = Decoder{Reader: bytes.NewReader([]byte{1, byte(FunctionId & 0xff), 99}), Registry: testRegistry}
+	if err := d.Decode(&value); err == nil {
+		t.Fatalf("expected error")
+	} else if e, ok := err.(*UnknownFuncError); !ok || e.Id != 99 {
+		t.Fatalf("expected UnknownFuncError, got %v", err)
+	}
+
+	d = Decoder{Reader: bytes.NewReader([]byte{1, 0, 3, 0, 0, 0, 'f', 'o', 'o'})}
+	if err := d.Decode(&value); err == nil {
+		t.Fatalf("expected error")
+	} else if e, ok := err.(*UnknownTypeError); !ok || e.Name != "foo" {
+		t.Fatalf("expected UnknownTypeError, got %v", err)
+	}
+}
+
+func TestDecodeGarbage(t *testing.T) {
+	data := encodeTestNode(makeTestNode())
+
+	for i := 0; i < len(data); i++ {
+		for _, b := range []byte{0x00, 0x7f, 0x80, 0xff} {
+			corrupted := append([]byte{}, data...)
+			corrupted[i] = b
+
+			var decoded *testNode
+			d := Decoder{Reader: bytes.NewReader(corrupted), Limits: DefaultLimits}
+			d.Decode(&decoded)
+		}
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	// a slice claiming 2^31-1 elements
+	var items []int64
+	d := Decoder{Reader: bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f}), Limits: DefaultLimits}
+	if err := d.Decode(&items); err == nil {
+		t.Fatalf("expected error")
+	} else if e, ok := err.(*LimitError); !ok || e.Limit != "length" {
+		t.Fatalf("expected length LimitError, got %v", err)
+	}
+
+	data := encodeTestNode(makeTestNode())
+
+	limits := []DecoderLimits{
+		{MaxBytes: int64(len(data) - 1)},
+		{MaxDepth: 2},
+		{MaxNodes: 2},
+	}
+	for _, limit := range limits {
+		var decoded *testNode
+		d := Decoder{Reader: bytes.NewReader(data), Limits: limit}
+		if _, ok := d.Decode(&decoded).(*LimitError); !ok {
+			t.Fatalf("%+v: expected LimitError", limit)
+		}
+	}
+
+	var decoded *testNode
+	d = Decoder{Reader: bytes.NewReader(data), Limits: DecoderLimits{MaxBytes: int64(len(data))}}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testMap struct {
+	Base
+
+	Counts   map[string]int32
+	Children map[int64]*testNode
+}
+
+func init() {
+	testRegistry.RegisterType("ads_test.testMap", &testMap{})
+}
+
+func TestMapEncoding(t *testing.T) {
+	a := &testMap{Counts: make(map[string]int32), Children: make(map[int64]*testNode)}
+	b := &testMap{Counts: make(map[string]int32), Children: make(map[int64]*testNode)}
+	for i := 0; i < 50; i++ {
+		a.Counts[string(rune('a'+i))] = int32(i)
+		b.Counts[string(rune('a'+49-i))] = int32(49 - i)
+		a.Children[int64(i)] = &testNode{Value: int32(i)}
+		b.Children[int64(49-i)] = &testNode{Value: int32(49 - i)}
+	}
+
+	if Hash(a) != Hash(b) {
+		t.Fatalf("map hash depends on insertion order")
+	}
+
+	if children := CollectChildren(a); len(children) != 50 || children[3].(*testNode).Value != 3 {
+		t.Fatalf("bad children %v", children)
+	}
+
+	buffer := new(bytes.Buffer)
+	e := Encoder{Writer: buffer, Transparent: map[ADS]bool{a: true}}
+	e.Encode(&a)
+
+	var decoded *testMap
+	d := Decoder{Reader: bytes.NewReader(buffer.Bytes())}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Counts) != 50 || decoded.Counts["c"] != 2 || !decoded.Children[7].IsOpaque() {
+		t.Fatalf("bad decode %+v", decoded)
+	}
+	if Hash(decoded) != Hash(a) {
+		t.Fatalf("hash mismatch")
+	}
+}
+
+func TestMapNonCanonical(t *testing.T) {
+	// {"b": 1, "a": 2}
+	data := []byte{
+		2, 0, 0, 0,
+		1, 0, 0, 0, 'b', 1, 0, 0, 0,
+		1, 0, 0, 0, 'a', 2, 0, 0, 0,
+	}
+
+	var m map[string]int32
+	d := Decoder{Reader: bytes.NewReader(data)}
+	if _, ok := d.Decode(&m).(*MalformedError); !ok {
+		t.Fatalf("expected MalformedError")
+	}
+}
+
+func TestCompactFormat(t *testing.T) {
+	n := makeTestNode()
+	n.Items = []int64{0, -1, 1 << 40, -(1 << 62)}
+
+	fixed := encodeTestNode(n)
+
+	buffer := new(bytes.Buffer)
+	e := Encoder{
+		Writer:      buffer,
+		Transparent: map[ADS]bool{n: true, n.Left: true},
+		Format:      CompactFormat,
+	}
+	e.Encode(&n)
+	compact := buffer.Bytes()
+
+	if len(compact) >= len(fixed) {
+		t.Fatalf("compact encoding is %d bytes, fixed is %d", len(compact), len(fixed))
+	}
+
+	var decoded *testNode
+	d := Decoder{Reader: bytes.NewReader(compact), Format: CompactFormat}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if Hash(decoded) != Hash(n) {
+		t.Fatalf("hash mismatch")
+	}
+	if decoded.Items[3] != -(1 << 62) {
+		t.Fatalf("bad items %v", decoded.Items)
+	}
+
+	// 2^31 does not fit in an int32
+	var value int32
+	d = Decoder{Reader: bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x10}), Format: CompactFormat}
+	if _, ok := d.Decode(&value).(*MalformedError); !ok {
+		t.Fatalf("expected MalformedError")
+	}
+}
+
+type testBadEncode struct {
+	Base
+
+	A, B int32
+}
+
+func (x *testBadEncode) Encode(e *Encoder) {
+	e.WriteInt(int64(x.B), 4)
+	e.WriteInt(int64(x.A), 4)
+}
+
+func (x *testBadEncode) Decode(d *Decoder) error {
+	return nil
+}
+
+func TestSelfCheck(t *testing.T) {
+	if err := SelfCheck(makeTestNode()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SelfCheck(&testBadEncode{A: 1, B: 2}); err == nil {
+		t.Fatalf("expected mismatch")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a, b := NewRegistry(), NewRegistry()
+	a.RegisterType("ads_test.testNode", &testNode{})
+	a.RegisterType("int64", int64(0))
+	b.RegisterType("int64", int64(0))
+	b.RegisterType("ads_test.testNode", &testNode{})
+
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Fatalf("fingerprint ignores ids")
+	}
+
+	n := makeTestNode()
+	buffer := new(bytes.Buffer)
+	if err := WriteProof(buffer, n, WriteOptions{Registry: a}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: b}); err == nil {
+		t.Fatalf("expected error")
+	} else if _, ok := err.(*FingerprintError); !ok {
+		t.Fatalf("expected FingerprintError, got %v", err)
+	}
+
+	proof, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Hash(proof.Root) != Hash(n) {
+		t.Fatalf("bad decode")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	shared := &testNode{Name: "shared", Items: []int64{1, 2, 3, 4, 5, 6, 7, 8}}
+	n := &testNode{Name: "root", Left: shared, Child: shared}
+	transparent := map[ADS]bool{n: true, shared: true}
+
+	var plain, deduped bytes.Buffer
+	e := Encoder{Writer: &plain, Transparent: transparent, Registry: testRegistry}
+	e.Encode(&n)
+	e = Encoder{Writer: &deduped, Transparent: transparent, Registry: testRegistry, Dedup: true}
+	e.Encode(&n)
+
+	if deduped.Len() >= plain.Len() {
+		t.Fatalf("dedup did not shrink encoding: %d vs %d bytes", deduped.Len(), plain.Len())
+	}
+
+	var decoded *testNode
+	d := Decoder{Reader: bytes.NewReader(deduped.Bytes()), Registry: testRegistry, Dedup: true}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Left != decoded.Child || Hash(decoded) != Hash(n) {
+		t.Fatalf("sharing not reconstructed")
+	}
+
+	d = Decoder{Reader: bytes.NewReader(deduped.Bytes()), Registry: testRegistry}
+	if err := d.Decode(&decoded); err == nil {
+		t.Fatalf("expected error decoding back-references without Dedup")
+	}
+
+	// A reference to the root from inside itself.
+	self := []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0}
+	d = Decoder{Reader: bytes.NewReader(self), Registry: testRegistry, Dedup: true}
+	if err := d.Decode(&decoded); err == nil {
+		t.Fatalf("expected error")
+	} else if _, ok := err.(*MalformedError); !ok {
+		t.Fatalf("expected MalformedError, got %v", err)
+	}
+}
+
+func TestConcurrentHash(t *testing.T) {
+	var nodes []*testNode
+	for i := 0; i < 100; i++ {
+		n := &testNode{Value: int32(i)}
+		if i > 0 {
+			n.Left = nodes[i-1]
+			n.Child = nodes[i/2]
+		}
+		nodes = append(nodes, n)
+	}
+	root := nodes[len(nodes)-1]
+
+	hashes := make(chan sha.Hash)
+	for i := 0; i < 8; i++ {
+		go func() {
+			hashes <- Hash(root)
+		}()
+	}
+
+	expected := <-hashes
+	for i := 1; i < 8; i++ {
+		if h := <-hashes; h != expected {
+			t.Fatalf("goroutines disagree on hash")
+		}
+	}
+	if expected != EncodedHash(root) {
+		t.Fatalf("bad cached hash")
+	}
+}
+
+func TestDecodeOverCachedHash(t *testing.T) {
+	n := makeTestNode()
+	buffer := new(bytes.Buffer)
+	e := Encoder{Writer: buffer, Transparent: map[ADS]bool{n: true}}
+	e.Encode(&n)
+
+	// The opaque Left decodes over a value with another hash cached.
+	decoded := makeTestNode()
+	decoded.Left.Name = "stale"
+	Hash(decoded.Left)
+	d := Decoder{Reader: bytes.NewReader(buffer.Bytes())}
+	if err := d.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Left.IsOpaque() || Hash(decoded.Left) != Hash(n.Left) {
+		t.Fatalf("decoding kept a stale hash")
+	}
+}
+
+// runUnderSchemeV1 reruns the test named name in a process that selects
+// sha.SchemeV1 before hashing anything. It returns true in that process.
+func runUnderSchemeV1(t *testing.T, name string) bool {
+	if os.Getenv("ADS_TEST_SCHEME") == "v1" {
+		sha.UseScheme(sha.SchemeV1)
+		return true
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$")
+	cmd.Env = append(os.Environ(), "ADS_TEST_SCHEME=v1")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	return false
+}
+
+func TestLegacyHashProof(t *testing.T) {
+	if !runUnderSchemeV1(t, "TestLegacyHashProof") {
+		return
+	}
+
+	n := makeTestNode()
+	buffer := new(bytes.Buffer)
+	if err := WriteProof(buffer, n, WriteOptions{Registry: testRegistry}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: testRegistry}); err != ErrLegacyHash {
+		t.Fatalf("expected ErrLegacyHash, got %v", err)
+	}
+	if _, err := ReadProof(bytes.NewReader(data), ReadOptions{Registry: testRegistry, AllowLegacyHash: true}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,20 +7,43 @@ import (
 	"certcomp/bitrie"
 	"certcomp/comp"
 	"certcomp/seqhash"
+	"certcomp/sha"
 	"certcomp/verified"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"time"
 )
 
 var BootstrapPath = flag.String("BootstrapPath", "/x/4/jelle/bootstrap.dat", "Location of bootstrap.dat")
 var BaseDbPath = flag.String("DbPath", "/x/4/jelle/db", "Where to store data.")
+var SelfCheck = flag.Bool("selfcheck", false, "Compare generated ADS methods against reflection while running.")
+var Workers = flag.Int("workers", runtime.NumCPU(), "Goroutines to hash with before paging.")
+var HasherName = flag.String("hasher", "sha256", "Hash function: sha256, sha512/256 or blake2b-256.")
+var LegacyHash = flag.Bool("legacyhash", false, "Hash nodes without domain separation, as before.")
+var Resume = flag.Bool("resume", false, "Continue from the DB's last checkpoint instead of starting over.")
+var SkipVerify = flag.Bool("skipverify", false, "Do not check paged-in records against their parents' hashes.")
+var PolicyName = flag.String("policy", "lru", "Eviction policy: lru, clock or 2q.")
+var BudgetMB = flag.Int64("budget", core.DefaultBudget>>20, "Memory to keep paged-in values in, in MB.")
+var HashDbPath = flag.String("hashdb", "", "Keep the nodes of all modes, stored once by hash, in one DB here instead of one per mode.")
+var WriteBack = flag.Int("writeback", 0, "Goroutines to encode evicted values with, written in the background; 0 writes them while processing.")
 
 func main() {
 	flag.Parse()
 
+	hasher, err := sha.ParseHasher(*HasherName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sha.Use(hasher)
+	if *LegacyHash {
+		sha.UseScheme(sha.SchemeV1)
+	}
+
 	var mode = flag.Arg(0)
 
 	var f func(b *core.Block, c comp.C) bitrie.Bitrie
@@ -33,11 +56,49 @@ func main() {
 		log.Fatalf("Usage: buildbalances [balances|transactions]")
 	}
 
-	core.RegisterTypes()
-	transactions.RegisterTypes()
-
-	db := core.CreateDB(filepath.Join(*BaseDbPath, mode))
-	pagingC := core.NewPagingC(db)
+	registry := ads.NewRegistry()
+	if err := transactions.RegisterTypes(registry); err != nil {
+		log.Fatal(err)
+	}
+	ads.UseRegistry(registry)
+
+	ads.CheckGenerated = *SelfCheck
+
+	var db *core.DB
+	var hashDB *core.HashDB
+	if *HashDbPath != "" {
+		// The DB is shared with the other modes, so it is never started over.
+		if _, err := os.Stat(*HashDbPath); err == nil {
+			db, err = core.ContinueDB(*HashDbPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			db = core.CreateDB(*HashDbPath, registry.Fingerprint())
+		}
+		if hashDB, err = core.OpenHashDB(db); err != nil {
+			log.Fatal(err)
+		}
+	} else if *Resume {
+		if db, err = core.ContinueDB(filepath.Join(*BaseDbPath, mode)); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		db = core.CreateDB(filepath.Join(*BaseDbPath, mode), registry.Fingerprint())
+	}
+	var store core.Store = db
+	commit := db.Commit
+	if hashDB != nil {
+		store = hashDB
+		commit = hashDB.Commit
+	}
+	pagingC := core.NewPagingC(store, registry)
+	pagingC.SkipVerify = *SkipVerify
+	if pagingC.Policy, err = core.NewEvictionPolicy(*PolicyName); err != nil {
+		log.Fatal(err)
+	}
+	pagingC.Budget = *BudgetMB << 20
+	pagingC.WriteBack = *WriteBack
 
 	file, err := os.Open(*BootstrapPath)
 	if err != nil {
@@ -52,21 +113,41 @@ func main() {
 	start := time.Now()
 	last := time.Now()
 
-	log.Println(ads.GetFuncId(f))
+	toCache, _ := registry.FuncId(f)
+	log.Println(toCache)
 
 	c := &verified.ProofC{
-		Outer:   pagingC,
-		Stack:   []*verified.LogTreap{nil},
-		ToCache: ads.GetFuncId(f),
+		Outer:    pagingC,
+		Stack:    []*verified.LogTreap{nil},
+		Registry: registry,
+		ToCache:  toCache,
 	}
 
 	var lastBlock *core.Block
 
 	c.Stack[0] = nil
 
-	c.Call(f, (*core.Block)(nil))
+	first := 0
+	if *Resume {
+		blocks, err := resume(c, pagingC, db, mode, hashDB == nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		first = int(blocks)
+	}
+	if first > 0 {
+		for i := 0; i < first; i++ {
+			if _, err := loader.readBlock(); err != nil {
+				log.Fatalf("couldn't skip block: %v\n", err)
+			}
+		}
+		log.Printf("resuming after %d blocks\n", first)
+	} else {
+		c.Call(f, (*core.Block)(nil))
+	}
 
-	for i := 0; ; i++ {
+	i := first
+	for ; ; i++ {
 		b, err := loader.readBlock()
 		if err != nil {
 			log.Fatalf("couldn't read block: %v\n", err)
@@ -88,11 +169,14 @@ func main() {
 		logtreap := c.Stack[0]
 		// markUsed(&c.Log[0])
 
-		pagingC.Unload()
+		if err := pagingC.Unload(); err != nil {
+			log.Fatal(err)
+		}
 
 		if i%100 == 0 {
 			// before we page logtreap, we must compute all seqhashes, or they'll be stored empty...
 			logtreap.SeqHash(c)
+			ads.HashParallel(logtreap, *Workers)
 			pagingC.MarkUsed(logtreap, true)
 
 			// dump(bitrie.Bits{}, balances)
@@ -100,11 +184,8 @@ func main() {
 		}
 
 		if i%1000 == 0 {
-			token := pagingC.Store(ads.GetInfo(logtreap))
+			token := checkpoint(c, pagingC, db, commit, mode, int64(i+1))
 			log.Printf("after %d: %d\n", i, token)
-			if err := db.BufferedWriter.Flush(); err != nil {
-				log.Panic(err)
-			}
 		}
 
 		bytes, _ := b.Bytes()
@@ -123,7 +204,8 @@ func main() {
 
 			ops := int64(logtreap.Count(c)) / 2
 
-			log.Printf("count: %d\n", pagingC.Count)
+			log.Printf("paged in: %d values, % 8.2f MB\n", pagingC.Policy.Len(), float64(pagingC.Policy.Bytes())/1000/1000)
+			log.Printf("%s: %v\n", *PolicyName, pagingC.Policy.Stats())
 			log.Printf("processed % 8.2f MB, % 5.2f MB/sec\n", float64(processed)/1000/1000, float64(processed/secs)/1000/1000)
 			log.Printf("procesnow % 8.2f MB, % 5.2f MB/sec\n", float64(processedNow)/1000/1000, float64(processedNow/nowSecs)/1000/1000)
 			log.Printf("merges    % 8.3fe6, % 5.3fe6 per sec\n", float64(seqhash.Calls)/1000/1000, float64(seqhash.Calls/secs)/1000/1000)
@@ -140,10 +222,95 @@ func main() {
 		}
 	}
 
-	logtreap := c.Stack[0]
-	token := pagingC.Store(ads.GetInfo(logtreap))
+	c.CachedLog.SeqHash(c)
+	token := checkpoint(c, pagingC, db, commit, mode, int64(i))
 	log.Printf("final: %d\n", token)
-	if err := db.BufferedWriter.Flush(); err != nil {
+
+	if hashDB != nil {
+		err = hashDB.Close()
+	} else {
+		err = db.Close()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkpoint stores the cached call each block's computation builds on and
+// commits it along with the number of blocks processed. The log is also
+// recorded in the manifest as "latest" and as "<mode>@height=<height>", and
+// both values as "<mode>@latest" and "<mode>@latest/exit" for resume; its
+// token is returned.
+func checkpoint(c *verified.ProofC, pagingC *core.PagingC, db *core.DB, commit func(core.Checkpoint) error, mode string, blocks int64) int64 {
+	if err := pagingC.Drain(); err != nil {
+		log.Fatal(err)
+	}
+	logToken := pagingC.Store(ads.GetInfo(c.CachedLog))
+	exitToken := pagingC.Store(ads.GetInfo(c.CachedExitEntry))
+
+	err := commit(core.Checkpoint{
+		Sequence: blocks,
+		Roots:    []int64{logToken, exitToken},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	meta := map[string]string{
+		"mode":   mode,
+		"blocks": strconv.FormatInt(blocks, 10),
+	}
+	root := core.Root{Token: logToken, Hash: ads.Hash(c.CachedLog), Meta: meta}
+	exit := core.Root{Token: exitToken, Hash: ads.Hash(c.CachedExitEntry), Meta: meta}
+	roots := map[string]core.Root{
+		"latest": root,
+		fmt.Sprintf("%s@height=%d", mode, blocks-1): root,
+		mode + "@latest":      root,
+		mode + "@latest/exit": exit,
+	}
+	if err := db.SetRoots(roots); err != nil {
 		log.Panic(err)
 	}
+
+	return logToken
+}
+
+// resume loads the cached call last stored by checkpoint for mode back into
+// c and returns the number of blocks processed, or 0 if there is none. DBs
+// from before the manifest recorded it resume from their last commit, if
+// fromCommit is set.
+func resume(c *verified.ProofC, pagingC *core.PagingC, db *core.DB, mode string, fromCommit bool) (int64, error) {
+	var roots []core.Root
+	var blocks int64
+	if root, found := db.Root(mode + "@latest"); found {
+		exit, found := db.Root(mode + "@latest/exit")
+		if !found {
+			return 0, fmt.Errorf("no exit entry recorded for %s", mode)
+		}
+		var err error
+		if blocks, err = strconv.ParseInt(root.Meta["blocks"], 10, 64); err != nil {
+			return 0, fmt.Errorf("bad block count for %s: %v", mode, err)
+		}
+		roots = []core.Root{root, exit}
+	} else if fromCommit && len(db.Committed.Roots) > 0 {
+		if len(db.Committed.Roots) != 2 {
+			return 0, fmt.Errorf("checkpoint has %d roots, expected 2", len(db.Committed.Roots))
+		}
+		blocks = db.Committed.Sequence
+		roots = []core.Root{{Token: db.Committed.Roots[0]}, {Token: db.Committed.Roots[1]}}
+	} else {
+		return 0, nil
+	}
+
+	logtreap := new(verified.LogTreap)
+	exitEntry := new(verified.LogEntry)
+	for i, value := range []ads.ADS{logtreap, exitEntry} {
+		if err := pagingC.LoadRoot(value, roots[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	c.CachedLog = logtreap
+	c.CachedExitEntry = exitEntry
+	return blocks, nil
 }
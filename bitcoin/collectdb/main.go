@@ -0,0 +1,94 @@
+package main
+
+import (
+	"certcomp/ads"
+	"certcomp/bitcoin/core"
+	"certcomp/bitcoin/transactions"
+	"certcomp/sha"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var DbPath = flag.String("DbPath", "/x/4/jelle/db/balances", "DB to collect.")
+var HasherName = flag.String("hasher", "sha256", "hash function the DB was built with")
+var LegacyHash = flag.Bool("legacyhash", false, "accept a DB built with the legacy hash scheme")
+var Unframed = flag.Bool("unframed", false, "upgrade a DB written before records were framed; roots must be given as tokens")
+
+// collectdb copies the records reachable from the roots given as arguments,
+// by name or token, or from the last committed roots if there are none, and
+// from the roots named in the manifest into a fresh DB. It then replaces
+// the old DB with it and prints the given roots' new tokens. This also
+// migrates the DB to the current token version, and, with -unframed, to
+// framed records with a commit log.
+func main() {
+	flag.Parse()
+
+	hasher, err := sha.ParseHasher(*HasherName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sha.Use(hasher)
+	if *LegacyHash {
+		sha.UseScheme(sha.SchemeV1)
+	}
+
+	registry := ads.NewRegistry()
+	if err := transactions.RegisterTypes(registry); err != nil {
+		log.Fatal(err)
+	}
+	ads.UseRegistry(registry)
+
+	var db *core.DB
+	if *Unframed {
+		db, err = core.OpenUnframedDB(*DbPath)
+	} else {
+		db, err = core.ContinueDB(*DbPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var roots []int64
+	for _, arg := range flag.Args() {
+		root, err := db.Lookup(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		roots = db.Committed.Roots
+	}
+	if len(roots) == 0 {
+		log.Fatal("no roots given and nothing committed")
+	}
+
+	collected := *DbPath + ".gc"
+	collectedDb, tokens, err := core.Collect(db, collected, registry, roots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := collectedDb.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	old := *DbPath + ".old"
+	if err := os.Rename(*DbPath, old); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(collected, *DbPath); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.RemoveAll(old); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, root := range roots {
+		fmt.Printf("%d -> %d\n", root, tokens[i])
+	}
+}
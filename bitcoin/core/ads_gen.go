@@ -0,0 +1,48 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package core
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *OutpointInfo) Encode(e *ads.Encoder) {
+	e.WriteLength(len(x.Count))
+	for i0 := range x.Count {
+		e.WriteInt(int64(x.Count[i0]), 1)
+	}
+}
+
+func (x *OutpointInfo) Decode(d *ads.Decoder) error {
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.Count = make([]int8, length)
+		for i0 := range x.Count {
+			{
+				value, err := d.ReadInt(1)
+				if err != nil {
+					return err
+				}
+				x.Count[i0] = int8(value)
+			}
+		}
+	}
+	return nil
+}
+
+func (x *OutpointInfo) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *OutpointInfo) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 1)
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&OutpointInfo{}, "Encode", "ComputeHash", "CollectChildren")
+}
@@ -1,5 +1,7 @@
 package core
 
+//go:generate adsgen
+
 import (
 	"bytes"
 	"certcomp/ads"
@@ -15,6 +17,7 @@ import (
 	"github.com/conformal/btcwire"
 	"log"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -28,8 +31,8 @@ func (t *Transaction) Encode(e *ads.Encoder) {
 	t.MsgTx.BtcEncode(e, btcwire.ProtocolVersion)
 }
 
-func (t *Transaction) Decode(d *ads.Decoder) {
-	t.MsgTx.BtcDecode(d, btcwire.ProtocolVersion)
+func (t *Transaction) Decode(d *ads.Decoder) error {
+	return ads.ReadError(t.MsgTx.BtcDecode(d, btcwire.ProtocolVersion))
 }
 
 func (t *Transaction) ComputeHash() sha.Hash {
@@ -60,16 +63,25 @@ func (b *Block) Encode(e *ads.Encoder) {
 	e.Encode(&b.Transactions)
 }
 
-func (b *Block) Decode(d *ads.Decoder) {
-	msgBlock := btcwire.MsgBlock{
-		Header: b.Header,
+func (b *Block) Decode(d *ads.Decoder) error {
+	var msgBlock btcwire.MsgBlock
+	if err := msgBlock.BtcDecode(d, btcwire.ProtocolVersion); err != nil {
+		return ads.ReadError(err)
 	}
-	msgBlock.BtcDecode(d, btcwire.ProtocolVersion)
+	if len(msgBlock.Transactions) != 0 {
+		return &ads.MalformedError{Reason: "block with inline transactions"}
+	}
+	b.Header = msgBlock.Header
 
-	d.Decode(&b.Previous)
-	d.Decode(&b.Transactions)
+	if err := d.Decode(&b.Previous); err != nil {
+		return err
+	}
+	if err := d.Decode(&b.Transactions); err != nil {
+		return err
+	}
 
-	// check that msgBlock has zero transactions and that the transaction merkle tree hash is correct
+	// check that the transaction merkle tree hash is correct
+	return nil
 }
 
 func (b *Block) ComputeHash() sha.Hash {
@@ -228,78 +240,96 @@ func CalculateBalances(block *Block, c comp.C) bitrie.Bitrie {
 	return c.Call(CalculateBalancesImpl, block)[0].(bitrie.Bitrie)
 }
 
+// PagingC keeps the values in use in memory, paging those Policy picks out
+// to Backend once they take more than Budget bytes.
 type PagingC struct {
-	DB                                 *DB
+	Backend                            Store
+	Registry                           *ads.Registry
+	fingerprint                        sha.Hash
 	LoadDiskTime, LoadTime, UnloadTime time.Duration
-	Head, Tail                         *ads.Info
-	Count                              int
 	Loads, Unloads                     int64
-}
 
-func NewPagingC(db *DB) *PagingC {
-	head, tail := &ads.Info{}, &ads.Info{}
-	head.Next = tail
-	tail.Prev = head
-	return &PagingC{
-		DB:   db,
-		Head: head,
-		Tail: tail,
-	}
-}
+	Policy EvictionPolicy
+	Budget int64
 
-func (c *PagingC) remove(info *ads.Info) {
-	a, b := info.Prev, info.Next
+	// WriteBack, if positive, is the number of goroutines encoding the
+	// values Unload evicts, which are then written in the background,
+	// with at most WriteBackQueue of them waiting.
+	WriteBack      int
+	WriteBackQueue int
+	writeBack      *writeBack
+	backendLock    sync.Mutex
 
-	a.Next = b
-	b.Prev = a
+	// SkipVerify turns off checking loaded values against the hashes
+	// their parents committed to, for speed.
+	SkipVerify bool
+}
 
-	info.Next = nil
-	info.Prev = nil
+// DefaultBudget is the memory budget of a new PagingC, in bytes.
+const DefaultBudget = 1 << 30
 
-	c.Count--
+func NewPagingC(backend Store, registry *ads.Registry) *PagingC {
+	return &PagingC{
+		Backend:     backend,
+		Registry:    registry,
+		fingerprint: registry.Fingerprint(),
+		Policy:      NewLRUPolicy(),
+		Budget:      DefaultBudget,
+	}
 }
 
 func (c *PagingC) MarkUsed(value ads.ADS, include bool) {
-	if value.IsOpaque() {
+	if value.IsOpaque() || !include && !c.Policy.Contains(ads.GetInfo(value)) {
 		return
 	}
 
-	info := ads.GetInfo(value)
+	// Values already tracked are touched without visiting their children;
+	// new ones are added after their children.
+	ads.Walk(value, ads.Visitor{
+		Pre: func(v *ads.Visit) error {
+			if v.Value.IsOpaque() {
+				return ads.SkipChildren
+			}
 
-	if info.Next != nil {
-		a, b := info.Prev, info.Next
-		a.Next = b
-		b.Prev = a
-	} else {
-		if !include {
-			return
-		} else {
-			for _, child := range ads.CollectChildren(value) {
-				c.MarkUsed(child, true)
+			info := ads.GetInfo(v.Value)
+			if c.Policy.Contains(info) {
+				c.Policy.Touch(info)
+				return ads.SkipChildren
+			}
+			return nil
+		},
+		Post: func(v *ads.Visit) error {
+			if v.Value.IsOpaque() {
+				return nil
 			}
-		}
-		c.Count++
-	}
 
-	a, b := c.Tail.Prev, c.Tail
-	a.Next = info
-	info.Prev = a
-	info.Next = b
-	b.Prev = info
+			info := ads.GetInfo(v.Value)
+			if !c.Policy.Contains(info) {
+				c.Policy.Add(info, approxSize(v.Value))
+			}
+			return nil
+		},
+	}, nil)
 }
 
 func (c *PagingC) Use(values ...ads.ADS) {
 	for _, value := range values {
 		comp.Uses++
 
+		// Loaded values, and those still being written back, are
+		// tracked again, having been dropped when they were evicted.
+		loaded := c.isPending(value)
 		if value.IsOpaque() {
 			c.Loads++
 
 			info := ads.GetInfo(value)
-			c.Load(info)
+			if err := c.Load(info); err != nil {
+				log.Panic(err)
+			}
+			loaded = true
 		}
 
-		c.MarkUsed(value, false)
+		c.MarkUsed(value, loaded)
 	}
 }
 
@@ -307,35 +337,99 @@ func (c *PagingC) Call(f interface{}, args ...interface{}) []interface{} {
 	return comp.Call(f, append(args, c))
 }
 
-func (c *PagingC) Load(info *ads.Info) {
+// HashMismatchError reports a record whose contents do not hash to the
+// value its parent committed to.
+type HashMismatchError struct {
+	Token            int64
+	Expected, Actual sha.Hash
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("record %d hashes to %v, expected %v", e.Token, e.Actual, e.Expected)
+}
+
+// Load decodes the value stored under info.Token, or under its cached hash
+// into info.Value. It fails if the store was written under
+// a different registry, or, unless SkipVerify is set, with a
+// HashMismatchError if the value does not hash to the hash cached on
+// info.Value. Values without a cached hash, such as roots loaded by token,
+// are not checked.
+func (c *PagingC) Load(info *ads.Info) error {
+	if store, ok := c.Backend.(Fingerprinter); ok && store.RegistryFingerprint() != c.fingerprint {
+		return &ads.FingerprintError{Expected: c.fingerprint, Actual: store.RegistryFingerprint()}
+	}
+
 	begin := time.Now()
 
-	data := c.DB.Read(info.Token)
+	c.backendLock.Lock()
+	data, err := c.Backend.Read(info.Token)
+	c.backendLock.Unlock()
+	if err != nil {
+		return err
+	}
 
 	c.LoadDiskTime += time.Now().Sub(begin)
 
 	begin = time.Now()
 	decoder := ads.Decoder{
-		Reader: bytes.NewBuffer(data),
+		Reader:   bytes.NewBuffer(data),
+		Registry: c.Registry,
 	}
 
-	decoder.Decode(&info.Value)
+	if err := decoder.Decode(&info.Value); err != nil {
+		return fmt.Errorf("decoding %d: %v", info.Token, err)
+	}
 	info.Value.MakeTransparent()
 
 	for _, root := range ads.CollectChildren(info.Value) {
 		var buffer [8]byte
-		if n, err := decoder.Read(buffer[:]); n != 8 || err != nil {
-			log.Panic(err)
+		if err := decoder.ReadFull(buffer[:]); err != nil {
+			return fmt.Errorf("decoding %d: %v", info.Token, err)
 		}
 
 		info := root.GetInfo()
 		info.Token = int64(binary.LittleEndian.Uint64(buffer[:]))
 	}
 
+	if err := decoder.Finish(); err != nil {
+		return fmt.Errorf("decoding %d: %v", info.Token, err)
+	}
+
+	if expected := info.Value.CachedHash(); expected != nil && !c.SkipVerify {
+		if actual := ads.ComputeHash(info.Value); actual != *expected {
+			return &HashMismatchError{Token: info.Token, Expected: *expected, Actual: actual}
+		}
+	}
+
 	c.LoadTime += time.Now().Sub(begin)
+	return nil
 }
 
+// LoadRoot loads the value stored as root into value, which must be of the
+// stored type, by root.Token. Unless SkipVerify is set, the value is
+// checked against root.Hash if it is not zero.
+func (c *PagingC) LoadRoot(value ads.ADS, root Root) error {
+	value.MakeOpaque()
+	info := ads.GetInfo(value)
+	info.Token = root.Token
+	if root.Hash != (sha.Hash{}) {
+		value.SetCachedHash(root.Hash)
+	}
+	return c.Load(info)
+}
+
+// Store writes info.Value, and whatever it refers to that has not been
+// written yet, and returns its token. It first drains the values being
+// written back, and like its own writes, it panics if they failed; call
+// Drain first to handle that.
 func (c *PagingC) Store(info *ads.Info) int64 {
+	if err := c.Drain(); err != nil {
+		log.Panic(err)
+	}
+	return c.store(info)
+}
+
+func (c *PagingC) store(info *ads.Info) int64 {
 	if info.Token != 0 {
 		return info.Token
 	}
@@ -349,12 +443,13 @@ func (c *PagingC) Store(info *ads.Info) int64 {
 	e := ads.Encoder{
 		Writer:      buffer,
 		Transparent: map[ads.ADS]bool{info.Value: true},
+		Registry:    c.Registry,
 	}
 	e.Encode(&info.Value)
 
 	for _, root := range ads.CollectChildren(info.Value) {
 		info := ads.GetInfo(root)
-		c.Store(info)
+		c.store(info)
 
 		var buffer [8]byte
 		binary.LittleEndian.PutUint64(buffer[:], uint64(info.Token))
@@ -363,74 +458,155 @@ func (c *PagingC) Store(info *ads.Info) int64 {
 		}
 	}
 
-	info.Token = c.DB.Write(buffer.Bytes())
+	token, err := c.Backend.Write(buffer.Bytes())
+	if err != nil {
+		log.Panic(err)
+	}
+	info.Token = token
 	return info.Token
 }
 
-const workingSet = 1000 * 1000
-
-func (c *PagingC) Unload() {
+// Unload pages out the values Policy picks until they fit in Budget. With
+// WriteBack, it returns the first error writing any of them back so far.
+func (c *PagingC) Unload() error {
 	begin := time.Now()
-	for c.Count > workingSet {
-		info := c.Head.Next
-		c.Store(info)
+	async := c.WriteBack > 0
+	if async {
+		if c.writeBack == nil {
+			c.startWriteBack()
+		}
+		c.reap(false)
+		if err := c.writeBack.err; err != nil {
+			return err
+		}
+	}
 
+	for c.Policy.Bytes() > c.Budget {
+		info := c.Policy.Evict()
+		if info == nil {
+			break
+		}
 		c.Unloads++
-		ads.MakeOpaque(info.Value)
 
-		c.remove(info)
+		if async {
+			if job := c.queueWrite(info.Value); job != nil {
+				job.evict = true
+				continue
+			}
+		} else {
+			c.store(info)
+		}
+		ads.MakeOpaque(info.Value)
 	}
 	c.UnloadTime += time.Now().Sub(begin)
+	return nil
 }
 
-func Dump(prefix bitrie.Bits, balances bitrie.Bitrie, c comp.C) {
-	if leaf, ok := balances.(*bitrie.BitrieLeaf); ok {
-		c.Use(leaf)
-		c.Use(leaf.Value)
-		fmt.Printf("%v: %v\n", hex.EncodeToString(prefix.Cat(leaf.Bits).Bits), leaf.Value.(*OutpointInfo).Count)
+// bitrieKey returns the key bits leading to the bitrie value v, given the
+// key bits consumed by each of its ancestors, by depth.
+func bitrieKey(prefix bitrie.Bits, consumed []bitrie.Bits, v *ads.Visit) bitrie.Bits {
+	if v.Parent == nil {
+		return prefix
+	}
+	if parent := v.Parent.Value.(*bitrie.BitrieNode); v.Value == ads.ADS(parent.Left) {
+		return consumed[v.Depth-1].Append(0)
 	}
+	return consumed[v.Depth-1].Append(1)
+}
 
-	if node, ok := balances.(*bitrie.BitrieNode); ok {
-		c.Use(node)
-		Dump(prefix.Cat(node.Bits).Append(0), node.Left, c)
-		Dump(prefix.Cat(node.Bits).Append(1), node.Right, c)
+func Dump(prefix bitrie.Bits, balances bitrie.Bitrie, c comp.C) {
+	var consumed []bitrie.Bits
+
+	err := ads.Walk(balances, ads.Visitor{
+		Pre: func(v *ads.Visit) error {
+			c.Use(v.Value)
+			switch value := v.Value.(type) {
+			case *bitrie.BitrieNode:
+				consumed = append(consumed[:v.Depth], bitrieKey(prefix, consumed, v).Cat(value.Bits))
+
+			case *bitrie.BitrieLeaf:
+				c.Use(value.Value)
+				key := bitrieKey(prefix, consumed, v).Cat(value.Bits)
+				fmt.Printf("%v: %v\n", hex.EncodeToString(key.Bits), value.Value.(*OutpointInfo).Count)
+				return ads.SkipChildren
+			}
+			return nil
+		},
+	}, nil)
+	if err != nil {
+		log.Panic(err)
 	}
 }
 
+// RandomKey follows random children from balances down to a leaf and
+// returns its key. Only the nodes on the way are paged in.
 func RandomKey(prefix bitrie.Bits, balances bitrie.Bitrie, c comp.C) bitrie.Bits {
-	if leaf, ok := balances.(*bitrie.BitrieLeaf); ok {
-		c.Use(leaf)
-		return prefix.Cat(leaf.Bits)
-	}
+	c.Use(balances)
+	switch value := balances.(type) {
+	case *bitrie.BitrieLeaf:
+		return prefix.Cat(value.Bits)
 
-	if node, ok := balances.(*bitrie.BitrieNode); ok {
-		c.Use(node)
+	case *bitrie.BitrieNode:
 		if rand.Intn(2) == 0 {
-			return RandomKey(prefix.Cat(node.Bits).Append(0), node.Left, c)
-		} else {
-			return RandomKey(prefix.Cat(node.Bits).Append(1), node.Right, c)
+			return RandomKey(prefix.Cat(value.Bits).Append(0), value.Left, c)
 		}
+		return RandomKey(prefix.Cat(value.Bits).Append(1), value.Right, c)
 	}
-
 	panic(balances)
 }
 
-func RegisterTypes() {
-	ads.RegisterType(0, &bitrie.BitrieLeaf{})
-	ads.RegisterType(1, &bitrie.BitrieNode{})
-	ads.RegisterType(2, &bitrie.BitrieNil{})
-	ads.RegisterType(3, &Transaction{})
-	ads.RegisterType(4, &bitrie.Tuple{})
-	ads.RegisterType(5, &seqhash.Hash{})
-	ads.RegisterType(6, &Block{})
-	ads.RegisterType(7, &OutpointInfo{})
-	ads.RegisterType(8, &verified.LogEntry{})
-	ads.RegisterType(9, &verified.LogTreeNode{})
-	ads.RegisterType(10, &verified.LogTreap{})
-	ads.RegisterType(11, btcwire.OutPoint{})
-
-	ads.RegisterFunc(0, ProcessBlock)
-	ads.RegisterFunc(1, ProcessTransactionImpl)
-	ads.RegisterFunc(2, CalculateBalancesImpl)
-	ads.RegisterFunc(3, ProcessOutpointImpl)
+func RegisterTypes(r *ads.Registry) error {
+	if err := bitrie.RegisterTypes(r); err != nil {
+		return err
+	}
+	if err := seqhash.RegisterTypes(r); err != nil {
+		return err
+	}
+	if err := verified.RegisterTypes(r); err != nil {
+		return err
+	}
+	if err := r.RegisterType("btcwire.OutPoint", btcwire.OutPoint{}); err != nil {
+		return err
+	}
+
+	n := r.Namespace("core")
+	n.RegisterType("Transaction", &Transaction{})
+	n.RegisterType("Block", &Block{})
+	n.RegisterType("OutpointInfo", &OutpointInfo{})
+
+	n.RegisterFunc("ProcessBlock", ProcessBlock)
+	n.RegisterFunc("ProcessTransactionImpl", ProcessTransactionImpl)
+	n.RegisterFunc("CalculateBalancesImpl", CalculateBalancesImpl)
+	n.RegisterFunc("ProcessOutpointImpl", ProcessOutpointImpl)
+	if err := n.Err(); err != nil {
+		return err
+	}
+
+	for name, id := range legacyIds {
+		if err := r.SetLegacyId(name, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyIds are the ids these types and functions had in the table the
+// bitcoin packages shared before Registries, which sha.SchemeV1 hashes by.
+var legacyIds = map[string]int8{
+	"bitrie.Leaf":                 0,
+	"bitrie.Node":                 1,
+	"bitrie.Nil":                  2,
+	"core.Transaction":            3,
+	"bitrie.Tuple":                4,
+	"seqhash.Hash":                5,
+	"core.Block":                  6,
+	"core.OutpointInfo":           7,
+	"verified.LogEntry":           8,
+	"verified.LogTreeNode":        9,
+	"verified.LogTreap":           10,
+	"btcwire.OutPoint":            11,
+	"core.ProcessBlock":           0,
+	"core.ProcessTransactionImpl": 1,
+	"core.CalculateBalancesImpl":  2,
+	"core.ProcessOutpointImpl":    3,
 }
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"certcomp/ads"
+	"testing"
+)
+
+func TestLoadVerify(t *testing.T) {
+	s := NewMemStore()
+	value := &OutpointInfo{Count: []int8{1, 2, 3}}
+	token := NewPagingC(s, testRegistry).Store(ads.GetInfo(value))
+	hash := ads.Hash(value)
+
+	// Flip the last count from 3 to 2.
+	record := s.records[token-1]
+	record[len(record)-1] ^= 1
+
+	for _, skip := range []bool{false, true} {
+		c := NewPagingC(s, testRegistry)
+		c.SkipVerify = skip
+		loaded := new(OutpointInfo)
+		loaded.MakeOpaque()
+		loaded.SetCachedHash(hash)
+		info := ads.GetInfo(loaded)
+		info.Token = token
+
+		err := c.Load(info)
+		if skip {
+			if err != nil {
+				t.Errorf("loading with SkipVerify: %v", err)
+			} else if count := loaded.Count; len(count) != 3 || count[2] != 2 {
+				t.Errorf("loaded %v", count)
+			}
+			continue
+		}
+		if mismatch, ok := err.(*HashMismatchError); !ok {
+			t.Errorf("expected HashMismatchError, got %v", err)
+		} else if mismatch.Token != token || mismatch.Expected != hash || mismatch.Actual == hash {
+			t.Errorf("bad error %+v", mismatch)
+		}
+	}
+}
@@ -2,7 +2,13 @@ package core
 
 import (
 	"bufio"
+	"bytes"
+	"certcomp/sha"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,16 +18,72 @@ import (
 type DB struct {
 	Path string
 
+	// Fingerprint is the fingerprint of the registry the data was written
+	// with, kept in the header file along with TokenVersion.
+	Fingerprint  sha.Hash
+	TokenVersion TokenVersion
+
 	Files map[int]*os.File
 	Id    int
 
 	BufferedWriter *bufio.Writer
 
 	Position int64
+
+	// Committed is the last checkpoint passed to Commit, or recovered by
+	// ContinueDB.
+	Committed Checkpoint
+	commits   *os.File
+
+	roots map[string]Root
+
+	// sizes caches the sizes of part files no longer written to, which
+	// bound the records read from them.
+	sizes map[int]int64
+
+	// unframed is set on DBs opened with OpenUnframedDB.
+	unframed bool
+}
+
+// A Checkpoint is a commit point in a DB: once Commit returns, every record
+// written before it is on disk. Roots are the tokens to resume from and
+// Sequence is for the writer to say how far it got.
+type Checkpoint struct {
+	Sequence int64
+	Roots    []int64
+
+	// Id and Position mark the end of the committed data.
+	Id       int
+	Position int64
 }
 
+// Every record is framed by its length and its CRC-32C, so that torn
+// writes and corruption are detected.
+const frameSize = 8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError reports a record whose frame does not match its token or
+// its contents.
+type ChecksumError struct {
+	Token int64
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("record %d is corrupt", e.Token)
+}
+
+// ErrNoCommitLog is returned by ContinueDB for DBs written before records
+// were framed, which have no commit log. Open those with OpenUnframedDB and
+// collect them into a new DB instead.
+var ErrNoCommitLog = errors.New("core: DB has no commit log")
+
+var errUnframed = errors.New("core: unframed DBs are read-only")
+
 const WriteBufferSize = 20 * 1000 * 1000
-const MaxFileSize = 4 * 1000 * 1000 * 1000
+
+const headerName = "header"
+const commitsName = "commits"
 
 func (db *DB) OpenFile(id int) *os.File {
 	path := filepath.Join(db.Path, fmt.Sprintf("part%d", id))
@@ -33,11 +95,13 @@ func (db *DB) OpenFile(id int) *os.File {
 	return file
 }
 
-func (db *DB) SwitchFile() {
-	if db.BufferedWriter != nil {
-		if err := db.BufferedWriter.Flush(); err != nil {
-			log.Panic(err)
-		}
+func (db *DB) SwitchFile() error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	if db.Id+1 >= db.TokenVersion.maxFiles() {
+		return fmt.Errorf("core: DB is full under %v tokens", db.TokenVersion)
 	}
 
 	db.Id++
@@ -45,9 +109,10 @@ func (db *DB) SwitchFile() {
 	db.BufferedWriter = bufio.NewWriterSize(file, WriteBufferSize)
 	db.Files[db.Id] = file
 	db.Position = 0
+	return nil
 }
 
-func CreateDB(path string) *DB {
+func CreateDB(path string, fingerprint sha.Hash) *DB {
 	os.MkdirAll(path, 0770)
 
 	files, _ := ioutil.ReadDir(path)
@@ -56,75 +121,456 @@ func CreateDB(path string) *DB {
 		os.Remove(filepath.Join(path, file.Name()))
 	}
 
+	header := append(fingerprint[:], byte(CurrentTokenVersion))
+	if err := ioutil.WriteFile(filepath.Join(path, headerName), header, 0660); err != nil {
+		log.Panicf("error writing header: %v\n", err)
+	}
+
+	commits, err := os.OpenFile(filepath.Join(path, commitsName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		log.Panicf("error creating commit log: %v\n", err)
+	}
+
 	db := &DB{
-		Path:     path,
-		Files:    make(map[int]*os.File),
-		Id:       -1,
-		Position: MaxFileSize,
+		Path:         path,
+		Fingerprint:  fingerprint,
+		TokenVersion: CurrentTokenVersion,
+		Files:        make(map[int]*os.File),
+		Id:           -1,
+		Committed:    Checkpoint{Id: -1},
+		commits:      commits,
+		roots:        make(map[string]Root),
 	}
 
 	return db
 }
 
-func ContinueDB(path string, token int64) *DB {
-	length := int(token >> 40)
-	id := int(token>>32) & ((1 << 8) - 1)
-	offset := token & ((1 << 32) - 1)
+// ContinueDB opens the DB at path for reading and further writing. It
+// recovers from a crash by dropping everything written after the last
+// intact entry in the commit log, including any torn records, and keeps
+// that entry in db.Committed.
+func ContinueDB(path string) (*DB, error) {
+	header, err := ioutil.ReadFile(filepath.Join(path, headerName))
+	if err != nil {
+		return nil, err
+	}
+	// Headers written before token versions were introduced hold only
+	// the fingerprint.
+	version := TokenV1
+	switch len(header) {
+	case len(sha.Hash{}):
+	case len(sha.Hash{}) + 1:
+		version = TokenVersion(header[len(sha.Hash{})])
+		if !version.Valid() {
+			return nil, fmt.Errorf("core: unknown token version %d", version)
+		}
+	default:
+		return nil, fmt.Errorf("core: bad header length %d", len(header))
+	}
 
-	db := &DB{
-		Path:     path,
-		Files:    make(map[int]*os.File),
-		Id:       id,
-		Position: offset + int64(length),
+	commits, err := os.OpenFile(filepath.Join(path, commitsName), os.O_RDWR|os.O_APPEND, 0660)
+	if os.IsNotExist(err) {
+		return nil, ErrNoCommitLog
+	} else if err != nil {
+		return nil, err
+	}
+
+	var db *DB
+	opened := false
+	defer func() {
+		if opened {
+			return
+		}
+		commits.Close()
+		if db != nil {
+			for _, file := range db.Files {
+				file.Close()
+			}
+		}
+	}()
+
+	roots, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	committed, end, err := readCommits(commits)
+	if err != nil {
+		return nil, err
+	}
+	if err := commits.Truncate(end); err != nil {
+		return nil, err
+	}
+
+	db = &DB{
+		Path:         path,
+		TokenVersion: version,
+		Files:        make(map[int]*os.File),
+		Id:           committed.Id,
+		Position:     committed.Position,
+		Committed:    committed,
+		commits:      commits,
+		roots:        roots,
+	}
+	copy(db.Fingerprint[:], header)
+
+	if err := db.dropUncommitted(); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i <= id; i++ {
+	for i := 0; i <= db.Id; i++ {
 		db.Files[i] = db.OpenFile(i)
 	}
+	if db.Id >= 0 {
+		if err := db.Files[db.Id].Truncate(db.Position); err != nil {
+			return nil, err
+		}
+		db.Files[db.Id].Seek(db.Position, os.SEEK_SET)
+		db.BufferedWriter = bufio.NewWriterSize(db.Files[db.Id], WriteBufferSize)
+	}
 
-	db.Files[id].Seek(db.Position, os.SEEK_SET)
-	db.BufferedWriter = bufio.NewWriterSize(db.Files[id], WriteBufferSize)
+	opened = true
+	return db, nil
+}
 
-	return db
+// OpenUnframedDB opens a DB written before records were framed, read-only,
+// so that Collect can copy it into a new DB. Such DBs use TokenV1 and have
+// no commit log or manifest, and their header holds only the fingerprint.
+// DBs without a header predate Registries, and their records cannot be
+// decoded by one; they have to be rebuilt.
+func OpenUnframedDB(path string) (*DB, error) {
+	header, err := ioutil.ReadFile(filepath.Join(path, headerName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("core: %v predates registries and must be rebuilt", path)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(header) != len(sha.Hash{}) {
+		return nil, fmt.Errorf("core: bad header length %d for an unframed DB", len(header))
+	}
+
+	db := &DB{
+		Path:         path,
+		TokenVersion: TokenV1,
+		Files:        make(map[int]*os.File),
+		Id:           -1,
+		Committed:    Checkpoint{Id: -1},
+		roots:        make(map[string]Root),
+		unframed:     true,
+	}
+	copy(db.Fingerprint[:], header)
+
+	for id := 0; ; id++ {
+		file, err := os.Open(filepath.Join(path, fmt.Sprintf("part%d", id)))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.Files[id] = file
+		db.Id = id
+	}
+	if db.Id < 0 {
+		return nil, fmt.Errorf("core: no data in %v", path)
+	}
+	return db, nil
 }
 
-func (db *DB) Write(data []byte) int64 {
-	if db.Position >= MaxFileSize {
-		db.SwitchFile()
+// dropUncommitted removes the part files started after the last commit.
+func (db *DB) dropUncommitted() error {
+	for id := db.Id + 1; ; id++ {
+		err := os.Remove(filepath.Join(db.Path, fmt.Sprintf("part%d", id)))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		log.Printf("dropped uncommitted part%d\n", id)
 	}
+}
 
-	if len(data) >= 1<<24 {
-		log.Panic("too big")
+// readCommits returns the last intact entry in the commit log and the
+// offset just past it.
+func readCommits(file *os.File) (Checkpoint, int64, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return Checkpoint{}, 0, err
 	}
 
-	if n, err := db.BufferedWriter.Write(data); n != len(data) || err != nil {
-		log.Panic(err)
+	committed := Checkpoint{Id: -1}
+	end := int64(0)
+	for {
+		payload, n := readFrame(data[end:])
+		if n == 0 {
+			return committed, end, nil
+		}
+		checkpoint, ok := decodeCheckpoint(payload)
+		if !ok {
+			return committed, end, nil
+		}
+		committed = checkpoint
+		end += int64(n)
+	}
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	var frame [frameSize]byte
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(data, castagnoli))
+	if _, err := w.Write(frame[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame returns the contents of the frame at the start of data and the
+// frame's total size, or a size of 0 if it is torn or corrupt.
+func readFrame(data []byte) ([]byte, int) {
+	if len(data) < frameSize {
+		return nil, 0
+	}
+	length := int(binary.LittleEndian.Uint32(data[:4]))
+	if length > len(data)-frameSize {
+		return nil, 0
 	}
+	payload := data[frameSize : frameSize+length]
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(data[4:frameSize]) {
+		return nil, 0
+	}
+	return payload, frameSize + length
+}
 
-	token := (int64(len(data)) << 40) | (int64(db.Id) << 32) | db.Position
-	db.Position += int64(len(data))
+func encodeCheckpoint(checkpoint Checkpoint) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, int64(checkpoint.Id))
+	binary.Write(&buffer, binary.LittleEndian, checkpoint.Position)
+	binary.Write(&buffer, binary.LittleEndian, checkpoint.Sequence)
+	binary.Write(&buffer, binary.LittleEndian, int64(len(checkpoint.Roots)))
+	binary.Write(&buffer, binary.LittleEndian, checkpoint.Roots)
+	return buffer.Bytes()
+}
 
-	return token
+func decodeCheckpoint(data []byte) (Checkpoint, bool) {
+	var fields [4]int64
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, fields[:]); err != nil {
+		return Checkpoint{}, false
+	}
+	if fields[3] < 0 || fields[3] != int64(reader.Len()/8) || reader.Len()%8 != 0 {
+		return Checkpoint{}, false
+	}
+
+	checkpoint := Checkpoint{
+		Id:       int(fields[0]),
+		Position: fields[1],
+		Sequence: fields[2],
+		Roots:    make([]int64, fields[3]),
+	}
+	binary.Read(reader, binary.LittleEndian, checkpoint.Roots)
+	return checkpoint, true
 }
 
-func (db *DB) Read(token int64) []byte {
-	length := int(token >> 40)
-	id := int(token>>32) & ((1 << 8) - 1)
-	offset := token & ((1 << 32) - 1)
+// Commit makes everything written so far durable and then records
+// checkpoint, with the current end of data, in the commit log. After a
+// crash, ContinueDB resumes from the last checkpoint committed.
+func (db *DB) Commit(checkpoint Checkpoint) error {
+	if db.unframed {
+		return errUnframed
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
 
-	if id == db.Id && offset+int64(length) >= db.Position-int64(db.BufferedWriter.Buffered()) {
-		if err := db.BufferedWriter.Flush(); err != nil {
-			log.Panic(err)
+	// Files before the last committed one were synced by earlier commits.
+	for id := db.Committed.Id; id <= db.Id; id++ {
+		if file, found := db.Files[id]; found {
+			if err := file.Sync(); err != nil {
+				return err
+			}
 		}
 	}
+	if err := syncDir(db.Path); err != nil {
+		return err
+	}
+
+	checkpoint.Id = db.Id
+	checkpoint.Position = db.Position
+	// The entry goes out in a single write, which a crash can tear but not
+	// interleave.
+	var frame bytes.Buffer
+	writeFrame(&frame, encodeCheckpoint(checkpoint))
+	if _, err := db.commits.Write(frame.Bytes()); err != nil {
+		return err
+	}
+	if err := db.commits.Sync(); err != nil {
+		return err
+	}
+
+	db.Committed = checkpoint
+	return nil
+}
+
+func (db *DB) Write(data []byte) (int64, error) {
+	if db.unframed {
+		return 0, errUnframed
+	}
+	// The first record starts a file.
+	if db.Id < 0 || db.Position >= db.TokenVersion.maxFileSize() {
+		if err := db.SwitchFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(data)) >= db.TokenVersion.maxLength() {
+		return 0, fmt.Errorf("core: record of %d bytes is too big for %v tokens", len(data), db.TokenVersion)
+	}
+
+	if err := writeFrame(db.BufferedWriter, data); err != nil {
+		return 0, err
+	}
+
+	token := db.TokenVersion.makeToken(len(data), db.Id, db.Position)
+	db.Position += frameSize + int64(len(data))
+
+	return token, nil
+}
+
+// flushFor flushes the write buffer if the data in file id up to end has
+// not all been written out yet.
+func (db *DB) flushFor(id int, end int64) error {
+	if id == db.Id && end > db.Position-int64(db.BufferedWriter.Buffered()) {
+		return db.Flush()
+	}
+	return nil
+}
+
+// fileSize returns the size of part file id, counting buffered records.
+func (db *DB) fileSize(id int) (int64, error) {
+	if id == db.Id {
+		return db.Position, nil
+	}
+	if size, found := db.sizes[id]; found {
+		return size, nil
+	}
+	info, err := db.Files[id].Stat()
+	if err != nil {
+		return 0, err
+	}
+	if db.sizes == nil {
+		db.sizes = make(map[int]int64)
+	}
+	db.sizes[id] = info.Size()
+	return info.Size(), nil
+}
+
+func (db *DB) Read(token int64) ([]byte, error) {
+	length, id, offset := db.TokenVersion.splitToken(token)
 
 	file := db.Files[id]
+	if file == nil {
+		return nil, &ChecksumError{Token: token}
+	}
+
+	if db.unframed {
+		buffer := make([]byte, length)
+		if _, err := file.ReadAt(buffer, offset); err == io.EOF {
+			return nil, &UnknownTokenError{Token: token}
+		} else if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	}
+
+	// Tokens that do not include the length leave it to the frame.
+	if length < 0 {
+		if err := db.flushFor(id, offset+frameSize); err != nil {
+			return nil, err
+		}
+
+		var frame [frameSize]byte
+		if _, err := file.ReadAt(frame[:], offset); err == io.EOF {
+			return nil, &ChecksumError{Token: token}
+		} else if err != nil {
+			return nil, err
+		}
+		length = int(binary.LittleEndian.Uint32(frame[:4]))
+
+		// The length is not checked by the CRC until the record is read,
+		// so a corrupt one must not make it allocate past the file.
+		size, err := db.fileSize(id)
+		if err != nil {
+			return nil, err
+		}
+		if offset+frameSize+int64(length) > size {
+			return nil, &ChecksumError{Token: token}
+		}
+	}
+
+	if err := db.flushFor(id, offset+frameSize+int64(length)); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, frameSize+length)
+	if _, err := file.ReadAt(buffer, offset); err == io.EOF {
+		return nil, &ChecksumError{Token: token}
+	} else if err != nil {
+		return nil, err
+	}
 
-	buffer := make([]byte, length)
-	n, err := file.ReadAt(buffer[:], offset)
-	if n != length || err != nil {
-		log.Panic(err)
+	data, size := readFrame(buffer)
+	if size != len(buffer) {
+		return nil, &ChecksumError{Token: token}
 	}
 
-	return buffer
+	return data, nil
+}
+
+// Flush writes out buffered records. They are only durable once committed.
+func (db *DB) Flush() error {
+	if db.BufferedWriter == nil {
+		return nil
+	}
+	return db.BufferedWriter.Flush()
+}
+
+// Close flushes buffered records and closes the DB's files. Records
+// written since the last commit are dropped when the DB is next opened.
+func (db *DB) Close() error {
+	err := db.Flush()
+	for _, file := range db.Files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if db.commits != nil {
+		if closeErr := db.commits.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// RegistryFingerprint returns db.Fingerprint, so that PagingC can check it.
+func (db *DB) RegistryFingerprint() sha.Hash {
+	return db.Fingerprint
+}
+
+// syncDir makes the creation and renaming of files in path durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+	return err
+}
+
+// isCommitted reports whether the record under token was written before
+// the last commit.
+func (db *DB) isCommitted(token int64) bool {
+	_, id, offset := db.TokenVersion.splitToken(token)
+	return id < db.Committed.Id || id == db.Committed.Id && offset < db.Committed.Position
 }
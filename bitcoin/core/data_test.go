@@ -0,0 +1,271 @@
+package core
+
+import (
+	"bytes"
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testRecords = [][]byte{[]byte("first"), []byte("second"), {}, bytes.Repeat([]byte{7}, 1000)}
+
+// writeTestRecords writes testRecords to db and returns their tokens.
+func writeTestRecords(t *testing.T, db *DB) []int64 {
+	var tokens []int64
+	for _, record := range testRecords {
+		token, err := db.Write(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func checkTestRecords(t *testing.T, db *DB, tokens []int64) {
+	for i, token := range tokens {
+		data, err := db.Read(token)
+		if err != nil {
+			t.Fatalf("reading record %d: %v", i, err)
+		}
+		if !bytes.Equal(data, testRecords[i]) {
+			t.Fatalf("record %d reads back as %q", i, data)
+		}
+	}
+}
+
+func continueDB(t *testing.T, path string) *DB {
+	db, err := ContinueDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestCommitReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	checkTestRecords(t, db, tokens)
+	if err := db.Commit(Checkpoint{Sequence: 3, Roots: tokens[:2]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = continueDB(t, dir)
+	if db.Committed.Sequence != 3 || len(db.Committed.Roots) != 2 || db.Committed.Roots[1] != tokens[1] {
+		t.Errorf("bad checkpoint %+v", db.Committed)
+	}
+	checkTestRecords(t, db, tokens)
+
+	// Writing goes on after the committed records.
+	more := writeTestRecords(t, db)
+	if err := db.Commit(Checkpoint{Sequence: 4}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	checkTestRecords(t, db, tokens)
+	checkTestRecords(t, db, more)
+}
+
+func TestTruncatedCommitLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{Sequence: 1})
+	writeTestRecords(t, db)
+	db.Commit(Checkpoint{Sequence: 2})
+	db.Close()
+
+	// A torn write of the last entry loses it, and what it committed.
+	commits := filepath.Join(dir, commitsName)
+	info, err := os.Stat(commits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(commits, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	db = continueDB(t, dir)
+	if db.Committed.Sequence != 1 {
+		t.Errorf("resumed from %+v, expected the first checkpoint", db.Committed)
+	}
+	checkTestRecords(t, db, tokens)
+	db.Close()
+
+	// The torn entry was cut off, so the log can be appended to.
+	db = continueDB(t, dir)
+	db.Commit(Checkpoint{Sequence: 5})
+	db.Close()
+	db = continueDB(t, dir)
+	defer db.Close()
+	if db.Committed.Sequence != 5 {
+		t.Errorf("resumed from %+v, expected the last checkpoint", db.Committed)
+	}
+}
+
+func TestFlippedByte(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{})
+	db.Close()
+
+	// Flip a byte of the first record's CRC.
+	part := filepath.Join(dir, "part0")
+	data, err := ioutil.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[5] ^= 1
+	if err := ioutil.WriteFile(part, data, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	if _, err := db.Read(tokens[0]); err == nil {
+		t.Errorf("expected error reading a corrupt record")
+	} else if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("expected ChecksumError, got %v", err)
+	}
+	if data, err := db.Read(tokens[1]); err != nil || !bytes.Equal(data, testRecords[1]) {
+		t.Errorf("next record reads back as %q, %v", data, err)
+	}
+}
+
+func TestCorruptLength(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{})
+	db.Close()
+
+	// A length past the end of the file is caught before it is read.
+	part := filepath.Join(dir, "part0")
+	data, err := ioutil.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data, []byte{0xff, 0xff, 0xff, 0xff})
+	if err := ioutil.WriteFile(part, data, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	if _, err := db.Read(tokens[0]); err == nil {
+		t.Errorf("expected error reading a record with a corrupt length")
+	} else if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("expected ChecksumError, got %v", err)
+	}
+	if data, err := db.Read(tokens[1]); err != nil || !bytes.Equal(data, testRecords[1]) {
+		t.Errorf("next record reads back as %q, %v", data, err)
+	}
+}
+
+func TestUncommittedDropped(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{Sequence: 1, Roots: tokens})
+
+	// Crash after writing a record but before committing it.
+	if _, err := db.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	if db.Committed.Sequence != 1 {
+		t.Errorf("resumed from %+v", db.Committed)
+	}
+	if db.Position != db.Committed.Position {
+		t.Errorf("writing resumes at %d, not at the commit at %d", db.Position, db.Committed.Position)
+	}
+	info, err := os.Stat(filepath.Join(dir, "part0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != db.Committed.Position {
+		t.Errorf("uncommitted record not truncated: %d bytes left", info.Size())
+	}
+	checkTestRecords(t, db, tokens)
+}
+
+// unframedStore writes records the way DBs did before they were framed.
+type unframedStore struct {
+	data []byte
+}
+
+func (s *unframedStore) Write(data []byte) (int64, error) {
+	token := TokenV1.makeToken(len(data), 0, int64(len(s.data)))
+	s.data = append(s.data, data...)
+	return token, nil
+}
+
+func (s *unframedStore) Read(token int64) ([]byte, error) {
+	length, _, offset := TokenV1.splitToken(token)
+	return s.data[offset : offset+int64(length)], nil
+}
+
+func (s *unframedStore) Flush() error { return nil }
+func (s *unframedStore) Close() error { return nil }
+
+func TestUpgradeUnframed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "old")
+	os.MkdirAll(old, 0770)
+	fingerprint := testRegistry.Fingerprint()
+	ioutil.WriteFile(filepath.Join(old, headerName), fingerprint[:], 0660)
+
+	store := &unframedStore{}
+	trie := addToTestTrie(bitrie.Nil, 0, 20)
+	token := NewPagingC(store, testRegistry).Store(ads.GetInfo(trie))
+	ioutil.WriteFile(filepath.Join(old, "part0"), store.data, 0660)
+
+	if _, err := ContinueDB(old); err != ErrNoCommitLog {
+		t.Fatalf("expected ErrNoCommitLog, got %v", err)
+	}
+
+	db, err := OpenUnframedDB(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Write([]byte("x")); err == nil {
+		t.Errorf("expected unframed DB to be read-only")
+	}
+
+	upgraded, tokens, err := Collect(db, filepath.Join(dir, "new"), testRegistry, []int64{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded.Close()
+
+	upgraded = continueDB(t, upgraded.Path)
+	defer upgraded.Close()
+	checkTestTrie(t, NewPagingC(upgraded, testRegistry), tokens[0], 20)
+}
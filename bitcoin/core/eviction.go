@@ -0,0 +1,382 @@
+package core
+
+import (
+	"certcomp/ads"
+	"fmt"
+	"reflect"
+)
+
+// An EvictionPolicy tracks the values PagingC keeps in memory, with their
+// approximate sizes, and picks which one to page out next.
+type EvictionPolicy interface {
+	// Add starts tracking info, whose value takes about size bytes.
+	Add(info *ads.Info, size int64)
+	// Touch records a use of the tracked info.
+	Touch(info *ads.Info)
+	Contains(info *ads.Info) bool
+	// Evict stops tracking the value to page out next and returns its
+	// info, or nil if nothing is tracked.
+	Evict() *ads.Info
+
+	Len() int
+	Bytes() int64
+	Stats() PolicyStats
+}
+
+// PolicyStats counts what an EvictionPolicy has seen. Hits are uses of
+// values already in memory; GhostHits are values added again soon after
+// being evicted, for policies that remember those.
+type PolicyStats struct {
+	Adds, Hits, Evictions, GhostHits int64
+}
+
+func (s PolicyStats) HitRate() float64 {
+	if s.Hits+s.Adds == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Adds)
+}
+
+func (s PolicyStats) String() string {
+	return fmt.Sprintf("adds %d, hits %d (%.1f%%), evictions %d, ghost hits %d",
+		s.Adds, s.Hits, 100*s.HitRate(), s.Evictions, s.GhostHits)
+}
+
+// NewEvictionPolicy returns the policy called name: "lru", "clock" or "2q".
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return NewLRUPolicy(), nil
+	case "clock":
+		return NewClockPolicy(), nil
+	case "2q":
+		return NewTwoQPolicy(), nil
+	}
+	return nil, fmt.Errorf("core: unknown eviction policy %q", name)
+}
+
+// infoList is a list of infos threaded through their Prev and Next fields.
+type infoList struct {
+	head, tail ads.Info
+	len        int
+	bytes      int64
+}
+
+func (l *infoList) init() {
+	l.head.Next = &l.tail
+	l.tail.Prev = &l.head
+}
+
+func (l *infoList) front() *ads.Info {
+	if l.len == 0 {
+		return nil
+	}
+	return l.head.Next
+}
+
+func (l *infoList) insertBefore(info, at *ads.Info) {
+	a := at.Prev
+	a.Next = info
+	info.Prev = a
+	info.Next = at
+	at.Prev = info
+
+	l.len++
+	l.bytes += info.Size
+}
+
+func (l *infoList) pushBack(info *ads.Info) {
+	l.insertBefore(info, &l.tail)
+}
+
+func (l *infoList) remove(info *ads.Info) {
+	a, b := info.Prev, info.Next
+	a.Next = b
+	b.Prev = a
+
+	info.Next = nil
+	info.Prev = nil
+
+	l.len--
+	l.bytes -= info.Size
+}
+
+// Info states. Untracked infos are always stateNone.
+const (
+	stateNone = iota
+	stateTracked
+	stateReferenced
+	stateIn
+	stateMain
+)
+
+// LRUPolicy evicts the least recently used value.
+type LRUPolicy struct {
+	list  infoList
+	stats PolicyStats
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	p := &LRUPolicy{}
+	p.list.init()
+	return p
+}
+
+func (p *LRUPolicy) Add(info *ads.Info, size int64) {
+	p.stats.Adds++
+	info.Size = size
+	info.State = stateTracked
+	p.list.pushBack(info)
+}
+
+func (p *LRUPolicy) Touch(info *ads.Info) {
+	p.stats.Hits++
+	p.list.remove(info)
+	p.list.pushBack(info)
+}
+
+func (p *LRUPolicy) Contains(info *ads.Info) bool {
+	return info.State != stateNone
+}
+
+func (p *LRUPolicy) Evict() *ads.Info {
+	info := p.list.front()
+	if info == nil {
+		return nil
+	}
+	p.stats.Evictions++
+	p.list.remove(info)
+	info.State = stateNone
+	return info
+}
+
+func (p *LRUPolicy) Len() int           { return p.list.len }
+func (p *LRUPolicy) Bytes() int64       { return p.list.bytes }
+func (p *LRUPolicy) Stats() PolicyStats { return p.stats }
+
+// ClockPolicy approximates LRU without reordering on use: values sit in a
+// ring, a use sets their referenced bit, and the hand passes over and
+// clears referenced values until it finds one to evict.
+type ClockPolicy struct {
+	list  infoList
+	hand  *ads.Info
+	stats PolicyStats
+}
+
+func NewClockPolicy() *ClockPolicy {
+	p := &ClockPolicy{}
+	p.list.init()
+	p.hand = &p.list.tail
+	return p
+}
+
+func (p *ClockPolicy) Add(info *ads.Info, size int64) {
+	p.stats.Adds++
+	info.Size = size
+	info.State = stateTracked
+	// Inserting behind the hand gives new values a full turn.
+	p.list.insertBefore(info, p.hand)
+}
+
+func (p *ClockPolicy) Touch(info *ads.Info) {
+	p.stats.Hits++
+	info.State = stateReferenced
+}
+
+func (p *ClockPolicy) Contains(info *ads.Info) bool {
+	return info.State != stateNone
+}
+
+func (p *ClockPolicy) Evict() *ads.Info {
+	if p.list.len == 0 {
+		return nil
+	}
+	for {
+		if p.hand == &p.list.tail {
+			p.hand = p.list.head.Next
+			continue
+		}
+		info := p.hand
+		p.hand = info.Next
+		if info.State == stateReferenced {
+			info.State = stateTracked
+			continue
+		}
+
+		p.stats.Evictions++
+		p.list.remove(info)
+		info.State = stateNone
+		return info
+	}
+}
+
+func (p *ClockPolicy) Len() int           { return p.list.len }
+func (p *ClockPolicy) Bytes() int64       { return p.list.bytes }
+func (p *ClockPolicy) Stats() PolicyStats { return p.stats }
+
+// TwoQPolicy is the 2Q policy of Johnson and Shasha. New values enter a
+// FIFO queue, and only move to the main LRU queue if they are added again
+// while still remembered as recently evicted from it, so that a single scan
+// over many values does not push out the ones used repeatedly.
+type TwoQPolicy struct {
+	in, main infoList
+
+	// ghosts are the infos last evicted from in, oldest first.
+	ghosts   []*ads.Info
+	ghostSet map[*ads.Info]bool
+	stats    PolicyStats
+}
+
+// The in queue may take up to 1/twoQInShare of the tracked bytes before
+// values are evicted from it rather than from main, and twoQGhostShare
+// ghosts are remembered per tracked value.
+const (
+	twoQInShare    = 4
+	twoQGhostShare = 0.5
+)
+
+func NewTwoQPolicy() *TwoQPolicy {
+	p := &TwoQPolicy{ghostSet: make(map[*ads.Info]bool)}
+	p.in.init()
+	p.main.init()
+	return p
+}
+
+func (p *TwoQPolicy) Add(info *ads.Info, size int64) {
+	p.stats.Adds++
+	info.Size = size
+	if p.ghostSet[info] {
+		p.stats.GhostHits++
+		delete(p.ghostSet, info)
+		info.State = stateMain
+		p.main.pushBack(info)
+		return
+	}
+	info.State = stateIn
+	p.in.pushBack(info)
+}
+
+func (p *TwoQPolicy) Touch(info *ads.Info) {
+	p.stats.Hits++
+	if info.State == stateMain {
+		p.main.remove(info)
+		p.main.pushBack(info)
+	}
+}
+
+func (p *TwoQPolicy) Contains(info *ads.Info) bool {
+	return info.State != stateNone
+}
+
+func (p *TwoQPolicy) Evict() *ads.Info {
+	var info *ads.Info
+	if p.in.len > 0 && (p.main.len == 0 || p.in.bytes*twoQInShare > p.Bytes()) {
+		info = p.in.front()
+		p.in.remove(info)
+		p.remember(info)
+	} else if p.main.len > 0 {
+		info = p.main.front()
+		p.main.remove(info)
+	} else {
+		return nil
+	}
+
+	p.stats.Evictions++
+	info.State = stateNone
+	return info
+}
+
+func (p *TwoQPolicy) remember(info *ads.Info) {
+	p.ghosts = append(p.ghosts, info)
+	p.ghostSet[info] = true
+
+	limit := int(float64(p.Len())*twoQGhostShare) + 1
+	for len(p.ghostSet) > limit && len(p.ghosts) > 0 {
+		delete(p.ghostSet, p.ghosts[0])
+		p.ghosts[0] = nil
+		p.ghosts = p.ghosts[1:]
+	}
+	// Ghosts readded since are still queued; drop them once they
+	// outnumber the live ones.
+	if len(p.ghosts) > 2*len(p.ghostSet)+16 {
+		var ghosts []*ads.Info
+		for _, ghost := range p.ghosts {
+			if p.ghostSet[ghost] {
+				ghosts = append(ghosts, ghost)
+			}
+		}
+		p.ghosts = ghosts
+	}
+}
+
+func (p *TwoQPolicy) Len() int           { return p.in.len + p.main.len }
+func (p *TwoQPolicy) Bytes() int64       { return p.in.bytes + p.main.bytes }
+func (p *TwoQPolicy) Stats() PolicyStats { return p.stats }
+
+var (
+	adsType  = reflect.TypeOf((*ads.ADS)(nil)).Elem()
+	baseType = reflect.TypeOf(ads.Base{})
+)
+
+// approxSize estimates the memory taken by value, not counting the ADS
+// values it refers to, which are tracked on their own.
+func approxSize(value ads.ADS) int64 {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return int64(v.Type().Size())
+	}
+	return int64(v.Elem().Type().Size()) + indirectSize(v.Elem())
+}
+
+// indirectSize estimates the memory v refers to beyond its own.
+func indirectSize(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() {
+			return 0
+		}
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += indirectSize(v.Index(i))
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += indirectSize(v.Index(i))
+		}
+		return size
+	case reflect.Struct:
+		if v.Type() == baseType {
+			return 0
+		}
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += indirectSize(v.Field(i))
+		}
+		return size
+	case reflect.Ptr:
+		if v.IsNil() || v.Type().Implements(adsType) {
+			return 0
+		}
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return indirectSize(v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+		t := v.Type()
+		size := int64(v.Len()) * int64(t.Key().Size()+t.Elem().Size())
+		for _, key := range v.MapKeys() {
+			size += indirectSize(key) + indirectSize(v.MapIndex(key))
+		}
+		return size
+	}
+	return 0
+}
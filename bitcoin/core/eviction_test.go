@@ -0,0 +1,89 @@
+package core
+
+import (
+	"certcomp/ads"
+	"testing"
+)
+
+// A policyOp adds, touches or evicts one of a test's infos. For evict,
+// info is the one expected out, or -1 for none.
+type policyOp struct {
+	op   string
+	info int
+	size int64
+}
+
+func addOp(info int, size int64) policyOp { return policyOp{"add", info, size} }
+func touchOp(info int) policyOp           { return policyOp{"touch", info, 0} }
+func evictOp(info int) policyOp           { return policyOp{"evict", info, 0} }
+
+func TestEvictionPolicies(t *testing.T) {
+	cases := []struct {
+		name      string
+		ops       []policyOp
+		ghostHits int64
+	}{
+		{"lru", []policyOp{
+			addOp(0, 10), addOp(1, 20), addOp(2, 30), touchOp(0),
+			evictOp(1), evictOp(2), addOp(3, 5), touchOp(0), evictOp(3), evictOp(0), evictOp(-1),
+		}, 0},
+		{"clock", []policyOp{
+			addOp(0, 10), addOp(1, 20), addOp(2, 30), touchOp(0),
+			evictOp(1), touchOp(2), evictOp(0), evictOp(2), evictOp(-1),
+		}, 0},
+		// Touches do not save values from the in queue.
+		{"2q", []policyOp{
+			addOp(0, 10), addOp(1, 10), addOp(2, 10), touchOp(0),
+			evictOp(0), evictOp(1), evictOp(2), evictOp(-1),
+		}, 0},
+		// A value added again while remembered goes to main, and outlives
+		// values added after it that are only in.
+		{"2q", []policyOp{
+			addOp(0, 10), addOp(1, 10), addOp(2, 10),
+			evictOp(0), addOp(0, 15), addOp(3, 10), addOp(4, 10),
+			evictOp(1), evictOp(2), evictOp(3), evictOp(4), evictOp(0), evictOp(-1),
+		}, 1},
+	}
+
+	for i, c := range cases {
+		p, err := NewEvictionPolicy(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos := make([]ads.Info, 5)
+		sizes := make(map[int]int64)
+		for j, op := range c.ops {
+			switch op.op {
+			case "add":
+				p.Add(&infos[op.info], op.size)
+				sizes[op.info] = op.size
+			case "touch":
+				p.Touch(&infos[op.info])
+			case "evict":
+				evicted := p.Evict()
+				if op.info < 0 && evicted != nil || op.info >= 0 && evicted != &infos[op.info] {
+					t.Fatalf("%s case %d op %d: expected %d evicted, got %v", c.name, i, j, op.info, evicted)
+				}
+				if op.info >= 0 {
+					if p.Contains(evicted) {
+						t.Errorf("%s case %d op %d: evicted info still tracked", c.name, i, j)
+					}
+					delete(sizes, op.info)
+				}
+			}
+
+			var bytes int64
+			for _, size := range sizes {
+				bytes += size
+			}
+			if p.Len() != len(sizes) || p.Bytes() != bytes {
+				t.Fatalf("%s case %d op %d: tracking %d values in %d bytes, expected %d in %d",
+					c.name, i, j, p.Len(), p.Bytes(), len(sizes), bytes)
+			}
+		}
+
+		if stats := p.Stats(); stats.GhostHits != c.ghostHits {
+			t.Errorf("%s case %d: %d ghost hits, expected %d", c.name, i, stats.GhostHits, c.ghostHits)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"certcomp/ads"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type collector struct {
+	from, to *DB
+	registry *ads.Registry
+	moved    map[int64]int64
+}
+
+// Collect copies the records reachable from roots into a new DB at path and
+// returns it along with the new token of each root, which it commits as the
+// new DB's roots. Records are reached through the child tokens
+// PagingC.Store appends to them, and are rewritten to refer to the copies;
+// records shared between roots are copied once. The roots named in db's
+// manifest are kept as well. db itself is left as it is, so swapping the
+// two is up to the caller; as with CreateDB, anything already at path is
+// deleted. The new DB uses CurrentTokenVersion, so collecting a DB also
+// migrates it from older token versions. If it fails, the new DB is closed
+// and removed. DBs holding a HashDB cannot be collected, as the index
+// mapping their records' hashes to tokens is not rebuilt.
+func Collect(db *DB, path string, registry *ads.Registry, roots []int64) (*DB, []int64, error) {
+	if fingerprint := registry.Fingerprint(); db.Fingerprint != fingerprint {
+		return nil, nil, &ads.FingerprintError{Expected: fingerprint, Actual: db.Fingerprint}
+	}
+	if _, err := os.Stat(filepath.Join(db.Path, indexName)); err == nil {
+		return nil, nil, fmt.Errorf("core: %v holds a HashDB, which cannot be collected", db.Path)
+	}
+	if absPath(path) == absPath(db.Path) {
+		return nil, nil, fmt.Errorf("collecting %v into itself", db.Path)
+	}
+
+	c := &collector{
+		from:     db,
+		to:       CreateDB(path, db.Fingerprint),
+		registry: registry,
+		moved:    make(map[int64]int64),
+	}
+
+	tokens, err := c.collect(roots)
+	if err != nil {
+		c.to.Close()
+		os.RemoveAll(path)
+		return nil, nil, err
+	}
+	return c.to, tokens, nil
+}
+
+func (c *collector) collect(roots []int64) ([]int64, error) {
+	tokens := make([]int64, len(roots))
+	for i, root := range roots {
+		token, err := c.copy(root)
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = token
+	}
+
+	// Named roots are kept too, under their new tokens.
+	named := make(map[string]Root)
+	for name, root := range c.from.roots {
+		token, err := c.copy(root.Token)
+		if err != nil {
+			return nil, err
+		}
+		root.Token = token
+		named[name] = root
+	}
+
+	if err := c.to.Commit(Checkpoint{Sequence: c.from.Committed.Sequence, Roots: tokens}); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(c.to.Path, named); err != nil {
+		return nil, err
+	}
+	c.to.roots = named
+	return tokens, nil
+}
+
+func absPath(path string) string {
+	abs, _ := filepath.Abs(path)
+	return abs
+}
+
+// copy writes the record under token, and everything it refers to, to the
+// new DB, children first so that their new tokens are known.
+func (c *collector) copy(token int64) (int64, error) {
+	if moved, found := c.moved[token]; found {
+		return moved, nil
+	}
+
+	data, err := c.from.Read(token)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bytes.NewReader(data)
+	decoder := ads.Decoder{
+		Reader:   reader,
+		Registry: c.registry,
+	}
+	var value ads.ADS
+	if err := decoder.Decode(&value); err != nil {
+		return 0, fmt.Errorf("decoding %d: %v", token, err)
+	}
+
+	children := len(ads.CollectChildren(value))
+	encoded := len(data) - reader.Len()
+	if reader.Len() != 8*children {
+		return 0, fmt.Errorf("decoding %d: %d trailing bytes for %d children", token, reader.Len(), children)
+	}
+
+	record := make([]byte, len(data))
+	copy(record, data[:encoded])
+	for i := 0; i < children; i++ {
+		offset := encoded + 8*i
+		child, err := c.copy(int64(binary.LittleEndian.Uint64(data[offset:])))
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint64(record[offset:], uint64(child))
+	}
+
+	moved, err := c.to.Write(record)
+	if err != nil {
+		return 0, err
+	}
+	c.moved[token] = moved
+	return moved, nil
+}
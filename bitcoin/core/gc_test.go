@@ -0,0 +1,106 @@
+package core
+
+import (
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"certcomp/comp"
+	"certcomp/sha"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(i int) bitrie.Bits {
+	return bitrie.MakeBits(sha.Sum([]byte{byte(i), byte(i >> 8)}))
+}
+
+// addToTestTrie maps the keys of first up to last to OutpointInfos holding
+// their index.
+func addToTestTrie(trie bitrie.Bitrie, first, last int) bitrie.Bitrie {
+	for i := first; i < last; i++ {
+		trie = trie.Set(testKey(i), &OutpointInfo{Count: []int8{int8(i)}}, comp.NilC)
+	}
+	return trie
+}
+
+// checkTestTrie loads the trie stored under token through c and checks
+// that it holds the keys up to n.
+func checkTestTrie(t *testing.T, c *PagingC, token int64, n int) {
+	checkTestRoot(t, c, Root{Token: token}, n)
+}
+
+func checkTestRoot(t *testing.T, c *PagingC, stored Root, n int) {
+	root := new(bitrie.BitrieNode)
+	if err := c.LoadRoot(root, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		value, found := root.Get(testKey(i), c)
+		if !found {
+			t.Fatalf("key %d not found", i)
+		}
+		c.Use(value)
+		if count := value.(*OutpointInfo).Count; len(count) != 1 || count[0] != int8(i) {
+			t.Fatalf("key %d holds %v", i, count)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "core")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func partSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(filepath.Join(path, "part0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestCollect(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(filepath.Join(dir, "db"), testRegistry.Fingerprint())
+	c := NewPagingC(db, testRegistry)
+
+	// The nodes the second version replaces are dead.
+	old := addToTestTrie(bitrie.Nil, 0, 20)
+	c.Store(ads.GetInfo(old))
+	trie := addToTestTrie(old, 20, 40)
+	token := c.Store(ads.GetInfo(trie))
+	if err := db.Commit(Checkpoint{Roots: []int64{token}}); err != nil {
+		t.Fatal(err)
+	}
+
+	collected, tokens, err := Collect(db, filepath.Join(dir, "gc"), testRegistry, []int64{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collected.Close()
+	defer db.Close()
+
+	if partSize(t, collected.Path) >= partSize(t, db.Path) {
+		t.Errorf("nothing collected")
+	}
+	if len(collected.Committed.Roots) != 1 || collected.Committed.Roots[0] != tokens[0] {
+		t.Errorf("roots not committed: %v", collected.Committed)
+	}
+	checkTestTrie(t, NewPagingC(collected, testRegistry), tokens[0], 40)
+
+	// A failed collection leaves nothing behind.
+	failed := filepath.Join(dir, "failed")
+	if _, _, err := Collect(db, failed, testRegistry, []int64{token + 1}); err == nil {
+		t.Errorf("expected error collecting a bad token")
+	}
+	if _, err := os.Stat(failed); !os.IsNotExist(err) {
+		t.Errorf("failed collection left %v: %v", failed, err)
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bufio"
+	"certcomp/sha"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const indexName = "index"
+
+// HashDB is a content-addressed Store kept in a DB, so that, like a
+// ContentStore, it writes identical records, and so identical subtrees,
+// once, across runs and the states built in it. The DB holds the records,
+// and an index file next to its parts maps the hash of each to its token.
+// Like the records, index entries only survive a crash once committed.
+type HashDB struct {
+	DB *DB
+
+	index  map[sha.Hash]int64
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// OpenHashDB opens the index of db, dropping the entries for records that
+// were not committed.
+func OpenHashDB(db *DB) (*HashDB, error) {
+	path := filepath.Join(db.Path, indexName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Entries are written in the same order as their records, so the
+	// first one past the last commit ends the valid ones.
+	index := make(map[sha.Hash]int64)
+	end := 0
+	for {
+		entry, n := readFrame(data[end:])
+		if n == 0 || len(entry) != len(sha.Hash{})+8 {
+			break
+		}
+		var hash sha.Hash
+		copy(hash[:], entry)
+		token := int64(binary.LittleEndian.Uint64(entry[len(hash):]))
+		if !db.isCommitted(token) {
+			break
+		}
+		index[hash] = token
+		end += n
+	}
+	if err := file.Truncate(int64(end)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &HashDB{
+		DB:     db,
+		index:  index,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (s *HashDB) Write(data []byte) (int64, error) {
+	hash := sha.Sum(data)
+	if token, found := s.index[hash]; found {
+		return token, nil
+	}
+
+	token, err := s.DB.Write(data)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := make([]byte, len(hash)+8)
+	copy(entry, hash[:])
+	binary.LittleEndian.PutUint64(entry[len(hash):], uint64(token))
+	if err := writeFrame(s.writer, entry); err != nil {
+		return 0, err
+	}
+
+	s.index[hash] = token
+	return token, nil
+}
+
+func (s *HashDB) Read(token int64) ([]byte, error) {
+	return s.DB.Read(token)
+}
+
+// Token returns the token of the record whose hash is hash.
+func (s *HashDB) Token(hash sha.Hash) (int64, bool) {
+	token, found := s.index[hash]
+	return token, found
+}
+
+func (s *HashDB) Flush() error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.DB.Flush()
+}
+
+// Commit makes the index durable and then commits the DB.
+func (s *HashDB) Commit(checkpoint Checkpoint) error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	return s.DB.Commit(checkpoint)
+}
+
+func (s *HashDB) Close() error {
+	err := s.writer.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := s.DB.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RegistryFingerprint returns the fingerprint of the underlying DB.
+func (s *HashDB) RegistryFingerprint() sha.Hash {
+	return s.DB.Fingerprint
+}
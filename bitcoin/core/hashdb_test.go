@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bytes"
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"certcomp/sha"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openHashDB(t *testing.T, db *DB) *HashDB {
+	s, err := OpenHashDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWriteExisting(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	hashDB := openHashDB(t, CreateDB(dir, testRegistry.Fingerprint()))
+	defer hashDB.Close()
+
+	for _, s := range []Store{NewContentStore(), hashDB} {
+		token, err := s.Write([]byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, err := s.Write([]byte("record")); err != nil || again != token {
+			t.Errorf("%T: rewrite got token %d, %v, expected %d", s, again, err, token)
+		}
+		if other, _ := s.Write([]byte("other")); other == token {
+			t.Errorf("%T: different records share token %d", s, token)
+		}
+		if data, err := s.Read(token); err != nil || !bytes.Equal(data, []byte("record")) {
+			t.Errorf("%T: read back %q, %v", s, data, err)
+		}
+	}
+
+	// The rewrite wrote nothing.
+	position := hashDB.DB.Position
+	hashDB.Write([]byte("record"))
+	if hashDB.DB.Position != position {
+		t.Errorf("rewriting an existing record wrote it again")
+	}
+
+	s := NewContentStore()
+	if _, err := s.ReadHash(sha.Sum([]byte("missing"))); err == nil {
+		t.Errorf("expected error")
+	} else if _, ok := err.(*UnknownHashError); !ok {
+		t.Errorf("expected UnknownHashError, got %v", err)
+	}
+}
+
+func TestHashDBTruncated(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openHashDB(t, CreateDB(dir, testRegistry.Fingerprint()))
+	s.Write([]byte("committed"))
+	if err := s.Commit(Checkpoint{Sequence: 1}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.Stat(filepath.Join(dir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash after the uncommitted entry reached the index.
+	s.Write([]byte("lost"))
+	s.Close()
+
+	s = openHashDB(t, continueDB(t, dir))
+	defer s.Close()
+	if _, found := s.Token(sha.Sum([]byte("committed"))); !found {
+		t.Errorf("committed record lost")
+	}
+	if _, found := s.Token(sha.Sum([]byte("lost"))); found {
+		t.Errorf("uncommitted record kept")
+	}
+	if info, err := os.Stat(filepath.Join(dir, indexName)); err != nil || info.Size() != index.Size() {
+		t.Errorf("index not truncated to its committed entries: %v, %v", info, err)
+	}
+
+	// Writing goes on after the committed entries.
+	token, err := s.Write([]byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Read(token); err != nil || !bytes.Equal(data, []byte("lost")) {
+		t.Errorf("read back %q, %v", data, err)
+	}
+}
+
+func TestPagingContentStore(t *testing.T) {
+	s := NewContentStore()
+	token := NewPagingC(s, testRegistry).Store(ads.GetInfo(addToTestTrie(bitrie.Nil, 0, 30)))
+	checkTestTrie(t, NewPagingC(s, testRegistry), token, 30)
+
+	// The same trie, built and stored again, is stored once.
+	records := len(s.hashes)
+	again := NewPagingC(s, testRegistry).Store(ads.GetInfo(addToTestTrie(bitrie.Nil, 0, 30)))
+	if again != token || len(s.hashes) != records {
+		t.Errorf("stored again under %d with %d more records", again, len(s.hashes)-records)
+	}
+}
+
+func TestHashDBRoots(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(filepath.Join(dir, "db"), testRegistry.Fingerprint())
+	s := openHashDB(t, db)
+	trie := addToTestTrie(bitrie.Nil, 0, 20)
+	token := NewPagingC(s, testRegistry).Store(ads.GetInfo(trie))
+	if err := s.Commit(Checkpoint{Roots: []int64{token}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRoot("latest", Root{Token: token, Hash: ads.Hash(trie)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	db = continueDB(t, db.Path)
+	s = openHashDB(t, db)
+	defer s.Close()
+	root, _ := db.Root("latest")
+	checkTestRoot(t, NewPagingC(s, testRegistry), root, 20)
+
+	// Storing the trie again in a later run adds nothing.
+	position := db.Position
+	if again := NewPagingC(s, testRegistry).Store(ads.GetInfo(addToTestTrie(bitrie.Nil, 0, 20))); again != token || db.Position != position {
+		t.Errorf("stored again under %d, %d bytes written", again, db.Position-position)
+	}
+
+	if _, _, err := Collect(db, filepath.Join(dir, "gc"), testRegistry, []int64{token}); err == nil {
+		t.Errorf("expected error collecting a HashDB")
+	}
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"certcomp/comp"
+	"certcomp/seqhash"
+	"certcomp/sha"
+	"certcomp/verified"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+var testRegistry = ads.NewRegistry()
+
+func init() {
+	if err := RegisterTypes(testRegistry); err != nil {
+		panic(err)
+	}
+	ads.UseRegistry(testRegistry)
+}
+
+// TestLegacyHashes checks that sha.SchemeV1 still gives the hashes computed
+// before Registries and hashing schemes. It runs in its own process, which
+// selects SchemeV1 before hashing anything.
+func TestLegacyHashes(t *testing.T) {
+	if os.Getenv("CORE_TEST_SCHEME") != "v1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLegacyHashes$")
+		cmd.Env = append(os.Environ(), "CORE_TEST_SCHEME=v1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		return
+	}
+	sha.UseScheme(sha.SchemeV1)
+
+	oi := &OutpointInfo{Count: []int8{1, 2}}
+	entry := &verified.LogEntry{
+		Type:          verified.FunctionEntry,
+		ArgsOrResults: []interface{}{oi, &OutpointInfo{}},
+		Func:          ProcessBlock,
+	}
+	exit := &verified.LogEntry{
+		Type:          verified.FunctionExit,
+		ArgsOrResults: []interface{}{bitrie.Nil},
+		Length:        3,
+	}
+	node := verified.CombineTree(entry, exit, comp.NilC)
+
+	var trie bitrie.Bitrie = bitrie.Nil
+	for i := 0; i < 5; i++ {
+		key := bitrie.MakeBits(sha.Sum([]byte{byte(i)}))
+		trie = trie.Set(key, &OutpointInfo{Count: []int8{int8(i)}}, comp.NilC)
+	}
+
+	seq := seqhash.New(entry)
+	for i := 0; i < 20; i++ {
+		e := &verified.LogEntry{
+			Type:          verified.FunctionExit,
+			ArgsOrResults: []interface{}{&OutpointInfo{Count: []int8{int8(i)}}},
+			Length:        int32(i),
+		}
+		seq = seqhash.Merge(seq, seqhash.New(e), comp.NilC)
+	}
+
+	golden := []struct {
+		name  string
+		value ads.ADS
+		hash  string
+	}{
+		{"OutpointInfo", oi, "8f06389c19928a558c59c8748fea6eab0c7bf57446666192123fd4273ca61e8a"},
+		{"entry", entry, "30e17630af44173eddae25f2d12c6c55980d7d1783154b393323fb07fed78a88"},
+		{"exit", exit, "6d535311a1230fdc8a353bbcb43c8fc708ce2a739818fbc6cd54faadb3586b4a"},
+		{"node", node, "e97ef1ba28605cdc06b06aed6ce2799b16b79dfd85b92debcc9cdfbae110c0a6"},
+		{"trie", trie, "cc497e8a01ac6fe2d79945eef8b7e80b9301a43239221eff1aee2585413b3b2f"},
+		{"seq", seq, "65d03470d17e0beabf3aab2d3d31429519e179084672efdd69ca94a087804ccd"},
+		{"finish", seq.Finish(comp.NilC), "abb91ba523e687e6e6c677ec01fbc33addf4e9ec6e0c5bc895b5b48b790ab166"},
+	}
+	for _, g := range golden {
+		if actual := ads.Hash(g.value).String(); actual != g.hash {
+			t.Errorf("%s hashes to %s, expected %s", g.name, actual, g.hash)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"certcomp/sha"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const manifestName = "MANIFEST"
+
+// A Root is a named state in a DB: the token of its root record, the hash
+// of the value stored there, and whatever the writer wants to note about it.
+type Root struct {
+	Token int64
+	Hash  sha.Hash
+	Meta  map[string]string
+}
+
+type manifestEntry struct {
+	Token int64             `json:"token"`
+	Hash  string            `json:"hash"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+func readManifest(path string) (map[string]Root, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, manifestName))
+	if os.IsNotExist(err) {
+		return make(map[string]Root), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("core: bad manifest: %v", err)
+	}
+
+	roots := make(map[string]Root)
+	for name, entry := range entries {
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil || len(hash) != len(sha.Hash{}) {
+			return nil, fmt.Errorf("core: bad hash for root %q in manifest", name)
+		}
+		root := Root{Token: entry.Token, Meta: entry.Meta}
+		copy(root.Hash[:], hash)
+		roots[name] = root
+	}
+	return roots, nil
+}
+
+// writeManifest replaces the manifest atomically: it is written to a
+// temporary file which is synced and then renamed over the old one.
+func writeManifest(path string, roots map[string]Root) error {
+	entries := make(map[string]manifestEntry)
+	for name, root := range roots {
+		entries[name] = manifestEntry{
+			Token: root.Token,
+			Hash:  hex.EncodeToString(root.Hash[:]),
+			Meta:  root.Meta,
+		}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp := filepath.Join(path, manifestName+".tmp")
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp, filepath.Join(path, manifestName)); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Root returns the root recorded under name.
+func (db *DB) Root(name string) (Root, bool) {
+	root, found := db.roots[name]
+	return root, found
+}
+
+// Roots returns the names of all recorded roots, sorted.
+func (db *DB) Roots() []string {
+	var names []string
+	for name := range db.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetRoot records root under name in the manifest, replacing any root
+// already there. Its records must have been committed, as after a crash
+// nothing else survives.
+func (db *DB) SetRoot(name string, root Root) error {
+	return db.SetRoots(map[string]Root{name: root})
+}
+
+// SetRoots records each of set under its name, as SetRoot does, in a
+// single update of the manifest, so that after a crash either all of them
+// or none are recorded.
+func (db *DB) SetRoots(set map[string]Root) error {
+	for name, root := range set {
+		if !db.isCommitted(root.Token) {
+			return fmt.Errorf("core: root %q refers to uncommitted record %d", name, root.Token)
+		}
+	}
+
+	roots := make(map[string]Root)
+	for name, root := range db.roots {
+		roots[name] = root
+	}
+	for name, root := range set {
+		roots[name] = root
+	}
+
+	if err := writeManifest(db.Path, roots); err != nil {
+		return err
+	}
+	db.roots = roots
+	return nil
+}
+
+// Lookup returns the token of the root called name, or, if there is none,
+// name itself parsed as a token.
+func (db *DB) Lookup(name string) (int64, error) {
+	if root, found := db.roots[name]; found {
+		return root.Token, nil
+	}
+	token, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("core: no root called %q", name)
+	}
+	return token, nil
+}
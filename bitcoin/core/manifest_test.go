@@ -0,0 +1,127 @@
+package core
+
+import (
+	"certcomp/sha"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{Roots: tokens})
+
+	latest := Root{Token: tokens[1], Hash: sha.Sum([]byte("latest")), Meta: map[string]string{"blocks": "2"}}
+	if err := db.SetRoot("latest", Root{Token: tokens[0]}); err != nil {
+		t.Fatal(err)
+	}
+	// SetRoots replaces latest.
+	err := db.SetRoots(map[string]Root{
+		"latest": latest,
+		"exit":   {Token: tokens[2]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	if root, found := db.Root("latest"); !found || root.Token != latest.Token || root.Hash != latest.Hash || root.Meta["blocks"] != "2" {
+		t.Errorf("latest reopened as %+v, %v", root, found)
+	}
+	if root, found := db.Root("exit"); !found || root.Token != tokens[2] {
+		t.Errorf("exit reopened as %+v, %v", root, found)
+	}
+	if names := db.Roots(); len(names) != 2 || names[0] != "exit" || names[1] != "latest" {
+		t.Errorf("roots reopened as %v", names)
+	}
+}
+
+func TestSetRootUncommitted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	defer db.Close()
+	committed := writeTestRecords(t, db)
+	db.Commit(Checkpoint{})
+	uncommitted := writeTestRecords(t, db)
+
+	if err := db.SetRoot("latest", Root{Token: uncommitted[0]}); err == nil {
+		t.Errorf("expected error recording an uncommitted root")
+	}
+	// No root of a rejected set is recorded.
+	err := db.SetRoots(map[string]Root{
+		"committed":   {Token: committed[0]},
+		"uncommitted": {Token: uncommitted[0]},
+	})
+	if err == nil {
+		t.Errorf("expected error recording an uncommitted root")
+	}
+	if names := db.Roots(); len(names) != 0 {
+		t.Errorf("recorded %v", names)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	defer db.Close()
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{})
+	db.SetRoot("latest", Root{Token: tokens[1]})
+
+	cases := []struct {
+		name  string
+		token int64
+		ok    bool
+	}{
+		{"latest", tokens[1], true},
+		{"12345", 12345, true},
+		{"-1", -1, true},
+		{"missing", 0, false},
+	}
+	for _, c := range cases {
+		token, err := db.Lookup(c.name)
+		if (err == nil) != c.ok || token != c.token {
+			t.Errorf("Lookup(%q) = %d, %v", c.name, token, err)
+		}
+	}
+}
+
+func TestInterruptedManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := CreateDB(dir, testRegistry.Fingerprint())
+	tokens := writeTestRecords(t, db)
+	db.Commit(Checkpoint{})
+	db.SetRoot("latest", Root{Token: tokens[0]})
+	db.Close()
+
+	// A crash while writing a new manifest leaves its temporary file.
+	temp := filepath.Join(dir, manifestName+".tmp")
+	if err := ioutil.WriteFile(temp, []byte(`{"latest": {"tok`), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	db = continueDB(t, dir)
+	defer db.Close()
+	if root, found := db.Root("latest"); !found || root.Token != tokens[0] {
+		t.Errorf("latest reopened as %+v, %v", root, found)
+	}
+	if err := db.SetRoot("latest", Root{Token: tokens[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("temporary manifest left: %v", err)
+	}
+}
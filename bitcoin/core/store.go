@@ -0,0 +1,160 @@
+package core
+
+import (
+	"certcomp/sha"
+	"errors"
+	"fmt"
+)
+
+// A Store holds the records PagingC pages values out to. Write returns a
+// nonzero token under which Read returns the same data; callers may reuse
+// the slice passed to Write, and must not modify the one Read returns.
+type Store interface {
+	Write(data []byte) (int64, error)
+	Read(token int64) ([]byte, error)
+	Flush() error
+	Close() error
+}
+
+// A Fingerprinter is a Store that keeps its data across runs and records
+// the fingerprint of the registry it was written with, so that it is not
+// read under another one.
+type Fingerprinter interface {
+	RegistryFingerprint() sha.Hash
+}
+
+// UnknownTokenError reports a token a Store did not hand out.
+type UnknownTokenError struct {
+	Token int64
+}
+
+func (e *UnknownTokenError) Error() string {
+	return fmt.Sprintf("core: unknown token %d", e.Token)
+}
+
+var ErrClosed = errors.New("core: store is closed")
+
+// MemStore keeps records in memory, for tests and short runs.
+type MemStore struct {
+	records [][]byte
+	closed  bool
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+func (s *MemStore) Write(data []byte) (int64, error) {
+	if s.closed {
+		return 0, ErrClosed
+	}
+	s.records = append(s.records, append([]byte(nil), data...))
+	return int64(len(s.records)), nil
+}
+
+func (s *MemStore) Read(token int64) ([]byte, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if token < 1 || token > int64(len(s.records)) {
+		return nil, &UnknownTokenError{Token: token}
+	}
+	return s.records[token-1], nil
+}
+
+func (s *MemStore) Flush() error {
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	s.closed = true
+	s.records = nil
+	return nil
+}
+
+// UnknownHashError reports a hash a content-addressed store does not hold.
+type UnknownHashError struct {
+	Hash sha.Hash
+}
+
+func (e *UnknownHashError) Error() string {
+	return fmt.Sprintf("core: no record with hash %v", e.Hash)
+}
+
+// ContentStore keeps records in memory keyed by their sha.Hash, so that
+// identical records are stored once and get the same token, and records
+// are checked against their hash when read. As a record holds its
+// children's tokens, identical subtrees are then stored once too.
+type ContentStore struct {
+	hashes  []sha.Hash
+	tokens  map[sha.Hash]int64
+	records map[sha.Hash][]byte
+	closed  bool
+}
+
+func NewContentStore() *ContentStore {
+	return &ContentStore{
+		tokens:  make(map[sha.Hash]int64),
+		records: make(map[sha.Hash][]byte),
+	}
+}
+
+func (s *ContentStore) Write(data []byte) (int64, error) {
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	hash := sha.Sum(data)
+	if token, found := s.tokens[hash]; found {
+		return token, nil
+	}
+
+	s.hashes = append(s.hashes, hash)
+	token := int64(len(s.hashes))
+	s.tokens[hash] = token
+	s.records[hash] = append([]byte(nil), data...)
+	return token, nil
+}
+
+func (s *ContentStore) Read(token int64) ([]byte, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if token < 1 || token > int64(len(s.hashes)) {
+		return nil, &UnknownTokenError{Token: token}
+	}
+	return s.ReadHash(s.hashes[token-1])
+}
+
+// ReadHash returns the record whose hash is hash.
+func (s *ContentStore) ReadHash(hash sha.Hash) ([]byte, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	data, found := s.records[hash]
+	if !found {
+		return nil, &UnknownHashError{Hash: hash}
+	}
+	if sha.Sum(data) != hash {
+		return nil, fmt.Errorf("core: record with hash %v is corrupt", hash)
+	}
+	return data, nil
+}
+
+// Hash returns the hash of the record under token.
+func (s *ContentStore) Hash(token int64) (sha.Hash, bool) {
+	if token < 1 || token > int64(len(s.hashes)) {
+		return sha.Hash{}, false
+	}
+	return s.hashes[token-1], true
+}
+
+func (s *ContentStore) Flush() error {
+	return nil
+}
+
+func (s *ContentStore) Close() error {
+	s.closed = true
+	s.records = nil
+	return nil
+}
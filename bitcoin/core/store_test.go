@@ -0,0 +1,47 @@
+package core
+
+import (
+	"bytes"
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+
+	data := []byte("record")
+	token, err := s.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == 0 {
+		t.Fatalf("zero token")
+	}
+	data[0] = 'R'
+	if read, err := s.Read(token); err != nil || !bytes.Equal(read, []byte("record")) {
+		t.Fatalf("read back %q, %v", read, err)
+	}
+
+	if _, err := s.Read(token + 1); err == nil {
+		t.Errorf("expected error")
+	} else if _, ok := err.(*UnknownTokenError); !ok {
+		t.Errorf("expected UnknownTokenError, got %v", err)
+	}
+
+	s.Close()
+	if _, err := s.Read(token); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := s.Write(data); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPagingMemStore(t *testing.T) {
+	s := NewMemStore()
+	trie := addToTestTrie(bitrie.Nil, 0, 30)
+	token := NewPagingC(s, testRegistry).Store(ads.GetInfo(trie))
+
+	checkTestTrie(t, NewPagingC(s, testRegistry), token, 30)
+}
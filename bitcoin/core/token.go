@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+)
+
+// A TokenVersion is a scheme for packing the location of a record into the
+// int64 token that refers to it. Each DB uses one, recorded in its header.
+type TokenVersion int
+
+const (
+	// TokenV1 packs a 24-bit length, an 8-bit file id and a 32-bit
+	// offset, limiting records to 16 MB and a DB to 256 files.
+	TokenV1 TokenVersion = 1
+	// TokenV2 packs a marker bit, a 14-bit file id and a 48-bit offset;
+	// the length is read from the record's frame.
+	TokenV2 TokenVersion = 2
+)
+
+// CurrentTokenVersion is used for new DBs. Older DBs are migrated by
+// collecting them into a new one.
+const CurrentTokenVersion = TokenV2
+
+// The marker bit keeps TokenV2 tokens nonzero, as a zero token means a
+// value has not been stored.
+const tokenV2Marker = 1 << 62
+
+func (v TokenVersion) Valid() bool {
+	return v == TokenV1 || v == TokenV2
+}
+
+func (v TokenVersion) maxFiles() int {
+	if v == TokenV1 {
+		return 1 << 8
+	}
+	return 1 << 14
+}
+
+// maxFileSize is the size after which a DB starts a new file. TokenV2
+// offsets have room for much larger files than TokenV1 ones.
+func (v TokenVersion) maxFileSize() int64 {
+	if v == TokenV1 {
+		return 4 * 1000 * 1000 * 1000
+	}
+	return 1 << 40
+}
+
+func (v TokenVersion) maxLength() int64 {
+	if v == TokenV1 {
+		return 1 << 24
+	}
+	return 1 << 32
+}
+
+func (v TokenVersion) makeToken(length int, id int, offset int64) int64 {
+	if v == TokenV1 {
+		return (int64(length) << 40) | (int64(id) << 32) | offset
+	}
+	return tokenV2Marker | (int64(id) << 48) | offset
+}
+
+// splitToken unpacks token. The length is -1 if the token does not
+// include it.
+func (v TokenVersion) splitToken(token int64) (length int, id int, offset int64) {
+	if v == TokenV1 {
+		// Lengths of 8 MB and up set the sign bit.
+		return int(uint64(token) >> 40), int(token>>32) & ((1 << 8) - 1), token & ((1 << 32) - 1)
+	}
+	return -1, int(token>>48) & ((1 << 14) - 1), token & ((1 << 48) - 1)
+}
+
+func (v TokenVersion) String() string {
+	return fmt.Sprintf("v%d", int(v))
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	cases := []struct {
+		version TokenVersion
+		length  int
+		id      int
+		offset  int64
+	}{
+		{TokenV1, 0, 0, 0},
+		{TokenV1, 1<<24 - 1, 255, 1<<32 - 1},
+		{TokenV1, 100, 3, 4000},
+		{TokenV2, 0, 0, 0},
+		{TokenV2, 100, 1<<14 - 1, 1<<48 - 1},
+		{TokenV2, 100, 3, 1 << 40},
+	}
+
+	for _, c := range cases {
+		token := c.version.makeToken(c.length, c.id, c.offset)
+		if token == 0 && c.version == TokenV2 {
+			t.Errorf("%v token for %+v is zero", c.version, c)
+		}
+		length, id, offset := c.version.splitToken(token)
+		if c.version == TokenV1 && length != c.length || id != c.id || offset != c.offset {
+			t.Errorf("%v token for %+v splits into %d, %d, %d", c.version, c, length, id, offset)
+		}
+		if c.version == TokenV2 && length != -1 {
+			t.Errorf("%v token for %+v has length %d", c.version, c, length)
+		}
+	}
+}
+
+func TestMigrateTokens(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "v1")
+	fingerprint := testRegistry.Fingerprint()
+	db := CreateDB(path, fingerprint)
+	db.TokenVersion = TokenV1
+	if err := ioutil.WriteFile(filepath.Join(path, headerName), append(fingerprint[:], byte(TokenV1)), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	trie := addToTestTrie(bitrie.Nil, 0, 20)
+	token := NewPagingC(db, testRegistry).Store(ads.GetInfo(trie))
+	db.Commit(Checkpoint{Roots: []int64{token}})
+	db.Close()
+
+	db = continueDB(t, path)
+	defer db.Close()
+	if db.TokenVersion != TokenV1 {
+		t.Fatalf("reopened as %v", db.TokenVersion)
+	}
+
+	migrated, tokens, err := Collect(db, filepath.Join(dir, "v2"), testRegistry, db.Committed.Roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated.Close()
+
+	migrated = continueDB(t, migrated.Path)
+	defer migrated.Close()
+	if migrated.TokenVersion != TokenV2 || tokens[0]&tokenV2Marker == 0 {
+		t.Fatalf("not migrated: %v, token %x", migrated.TokenVersion, tokens[0])
+	}
+	checkTestTrie(t, NewPagingC(migrated, testRegistry), tokens[0], 20)
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"certcomp/ads"
+	"encoding/binary"
+)
+
+// DefaultWriteBackQueue bounds how many values may be waiting to be written
+// back before Unload blocks.
+const DefaultWriteBackQueue = 4096
+
+// A writeJob writes one value. Jobs are encoded concurrently but written
+// in the order they were queued, so that a value's children, queued before
+// it, have their tokens by the time it is written.
+type writeJob struct {
+	value    ads.ADS
+	info     *ads.Info
+	children []writeRef
+	data     *bytes.Buffer
+	encoded  chan struct{}
+
+	// token and err are set by the writer before it closes written.
+	token   int64
+	err     error
+	written chan struct{}
+
+	// evict is only used by the processing goroutine: the value is made
+	// opaque once written, unless it has been used again since.
+	evict bool
+}
+
+// A writeRef refers to a child, by its token if it has one, or else by the
+// job writing it.
+type writeRef struct {
+	token int64
+	job   *writeJob
+}
+
+// writeBack encodes and writes values evicted by Unload on background
+// goroutines. Evicted values stay in memory until written, so that they can
+// be used again in the meantime; only the processing goroutine touches
+// their infos, when it reaps finished jobs.
+type writeBack struct {
+	encode, order chan *writeJob
+	// queue holds the jobs not reaped yet, in order.
+	queue   []*writeJob
+	pending map[*ads.Info]*writeJob
+	// err is the first error a job failed with.
+	err error
+}
+
+func (c *PagingC) startWriteBack() {
+	size := c.WriteBackQueue
+	if size <= 0 {
+		size = DefaultWriteBackQueue
+	}
+	w := &writeBack{
+		encode:  make(chan *writeJob, size),
+		order:   make(chan *writeJob, size),
+		pending: make(map[*ads.Info]*writeJob),
+	}
+	for i := 0; i < c.WriteBack; i++ {
+		go c.encodeJobs(w.encode)
+	}
+	go c.writeJobs(w.order)
+	c.writeBack = w
+}
+
+func (c *PagingC) encodeJobs(jobs <-chan *writeJob) {
+	for job := range jobs {
+		job.data = ads.GetFromPool()
+		e := ads.Encoder{
+			Writer:      job.data,
+			Transparent: map[ads.ADS]bool{job.value: true},
+			Registry:    c.Registry,
+		}
+		e.Encode(&job.value)
+		close(job.encoded)
+	}
+}
+
+func (c *PagingC) writeJobs(jobs <-chan *writeJob) {
+	for job := range jobs {
+		<-job.encoded
+
+		// A value whose child failed to be written fails too.
+		for _, child := range job.children {
+			token := child.token
+			if child.job != nil {
+				if child.job.err != nil {
+					job.err = child.job.err
+					break
+				}
+				token = child.job.token
+			}
+			var buffer [8]byte
+			binary.LittleEndian.PutUint64(buffer[:], uint64(token))
+			job.data.Write(buffer[:])
+		}
+
+		if job.err == nil {
+			c.backendLock.Lock()
+			job.token, job.err = c.Backend.Write(job.data.Bytes())
+			c.backendLock.Unlock()
+		}
+
+		ads.ReturnToPool(job.data)
+		job.data = nil
+		close(job.written)
+	}
+}
+
+// queueWrite queues value, and whatever it refers to that has not been
+// written or queued yet, and returns its job, or nil if it has a token.
+func (c *PagingC) queueWrite(value ads.ADS) *writeJob {
+	w := c.writeBack
+	info := ads.GetInfo(value)
+	if info.Token != 0 {
+		return nil
+	}
+	if job, found := w.pending[info]; found {
+		return job
+	}
+
+	// Encoding reads the cached hashes of the children.
+	ads.Hash(value)
+
+	job := &writeJob{
+		value:   value,
+		info:    info,
+		encoded: make(chan struct{}),
+		written: make(chan struct{}),
+	}
+	for _, child := range ads.CollectChildren(value) {
+		ref := writeRef{job: c.queueWrite(child)}
+		if ref.job == nil {
+			ref.token = ads.GetInfo(child).Token
+		}
+		job.children = append(job.children, ref)
+	}
+
+	for len(w.queue) >= cap(w.order) {
+		c.reap(true)
+	}
+	w.queue = append(w.queue, job)
+	w.pending[info] = job
+	w.encode <- job
+	w.order <- job
+	return job
+}
+
+// reap finishes the written jobs at the front of the queue, waiting for
+// the first one if wait is set. Values that failed to be written keep no
+// token and stay in memory, tracked by the Policy again so that they count
+// against the Budget and are written when next evicted, and the first
+// error is kept for Drain and Unload to return.
+func (c *PagingC) reap(wait bool) {
+	w := c.writeBack
+	for len(w.queue) > 0 {
+		job := w.queue[0]
+		if wait {
+			<-job.written
+			wait = false
+		} else {
+			select {
+			case <-job.written:
+			default:
+				return
+			}
+		}
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		delete(w.pending, job.info)
+
+		if job.err != nil {
+			if w.err == nil {
+				w.err = job.err
+			}
+			if !c.Policy.Contains(job.info) {
+				c.Policy.Add(job.info, approxSize(job.info.Value))
+			}
+			continue
+		}
+		job.info.Token = job.token
+		if job.evict && !c.Policy.Contains(job.info) {
+			ads.MakeOpaque(job.info.Value)
+		}
+	}
+}
+
+// isPending returns whether value is waiting to be written back.
+func (c *PagingC) isPending(value ads.ADS) bool {
+	if c.writeBack == nil {
+		return false
+	}
+	_, found := c.writeBack.pending[ads.GetInfo(value)]
+	return found
+}
+
+// Drain waits for all values queued by Unload to be written and stops the
+// goroutines writing them, returning the first error writing any of them.
+// They are started again by the next Unload.
+func (c *PagingC) Drain() error {
+	w := c.writeBack
+	if w == nil {
+		return nil
+	}
+	for len(w.queue) > 0 {
+		c.reap(true)
+	}
+	close(w.encode)
+	close(w.order)
+	c.writeBack = nil
+	return w.err
+}
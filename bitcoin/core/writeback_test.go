@@ -0,0 +1,117 @@
+package core
+
+import (
+	"certcomp/ads"
+	"certcomp/bitrie"
+	"certcomp/sha"
+	"errors"
+	"testing"
+)
+
+// buildPaged builds the test trie through c in steps, unloading after
+// each one and then reading back earlier keys, and stores its root.
+func buildPaged(t *testing.T, c *PagingC, n int) (bitrie.Bitrie, int64) {
+	var trie bitrie.Bitrie = bitrie.Nil
+	for step := 0; step < n; step += 20 {
+		for i := step; i < step+20 && i < n; i++ {
+			trie = trie.Set(testKey(i), &OutpointInfo{Count: []int8{int8(i)}}, c)
+		}
+		c.MarkUsed(trie, true)
+		if err := c.Unload(); err != nil {
+			t.Fatal(err)
+		}
+		if c.WriteBack > 0 && !c.isPending(trie) {
+			t.Fatalf("root not pending after step %d", step)
+		}
+
+		for i := 0; i < step; i += 3 {
+			if _, found := trie.Get(testKey(i), c); !found {
+				t.Fatalf("key %d not found after step %d", i, step)
+			}
+		}
+	}
+
+	if err := c.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	return trie, c.Store(ads.GetInfo(trie))
+}
+
+func TestWriteBack(t *testing.T) {
+	const n = 120
+	var hashes [2]sha.Hash
+	for i, writeBack := range []int{0, 3} {
+		s := NewMemStore()
+		c := NewPagingC(s, testRegistry)
+		c.Budget = 1
+		c.WriteBack = writeBack
+		c.WriteBackQueue = 8
+		trie, token := buildPaged(t, c, n)
+
+		c = NewPagingC(s, testRegistry)
+		checkTestTrie(t, c, token, n)
+		root := new(bitrie.BitrieNode)
+		if err := c.LoadRoot(root, Root{Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		if hashes[i] = ads.Hash(root); hashes[i] != ads.Hash(trie) {
+			t.Errorf("writeback %d: stored root hashes to %v, built %v", writeBack, hashes[i], ads.Hash(trie))
+		}
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("written back root hashes to %v, expected %v", hashes[1], hashes[0])
+	}
+}
+
+var errTestWrite = errors.New("write failed")
+
+// failingStore fails every Write while fail is set.
+type failingStore struct {
+	MemStore
+	fail bool
+}
+
+func (s *failingStore) Write(data []byte) (int64, error) {
+	if s.fail {
+		return 0, errTestWrite
+	}
+	return s.MemStore.Write(data)
+}
+
+func TestWriteBackError(t *testing.T) {
+	s := &failingStore{fail: true}
+	c := NewPagingC(s, testRegistry)
+	c.Budget = 1
+	c.WriteBack = 2
+	trie := addToTestTrie(bitrie.Nil, 0, 20)
+	c.MarkUsed(trie, true)
+	tracked, bytes := c.Policy.Len(), c.Policy.Bytes()
+	if err := c.Unload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Drain(); err != errTestWrite {
+		t.Fatalf("expected %v from Drain, got %v", errTestWrite, err)
+	}
+
+	// Values that were not written stay in memory, and are tracked again.
+	if trie.IsOpaque() || ads.GetInfo(trie).Token != 0 {
+		t.Errorf("unwritten root paged out")
+	}
+	if c.Policy.Len() != tracked || c.Policy.Bytes() != bytes {
+		t.Errorf("tracking %d values in %d bytes after failing, expected %d in %d",
+			c.Policy.Len(), c.Policy.Bytes(), tracked, bytes)
+	}
+
+	// Once writes succeed, they are evicted again.
+	s.fail = false
+	if err := c.Unload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Policy.Len() != 0 || !trie.IsOpaque() {
+		t.Errorf("%d values left after writing", c.Policy.Len())
+	}
+	checkTestTrie(t, NewPagingC(s, testRegistry), ads.GetInfo(trie).Token, 20)
+}
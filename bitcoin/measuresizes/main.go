@@ -6,9 +6,11 @@ import (
 	"certcomp/bitrie"
 	"certcomp/comp"
 	"certcomp/seqhash"
+	"certcomp/sha"
 	"certcomp/verified"
 	"flag"
 	"fmt"
+	"log"
 	//"github.com/davecgh/go-spew/spew"
 	"math/rand"
 	"path/filepath"
@@ -17,7 +19,21 @@ import (
 
 var BaseDbPath = flag.String("DbPath", "/x/4/jelle/db", "Where to store data.")
 
-var treapToken = flag.Int64("token", 0, "token from builder")
+var treapRoot = flag.String("token", "latest", "name of the state in the DB's manifest, or token from builder")
+
+var formatName = flag.String("format", "fixed", "wire format to measure: fixed or compact")
+
+var dedup = flag.Bool("dedup", false, "write shared values once, with back-references")
+
+var hasherName = flag.String("hasher", "sha256", "hash function the DB was built with")
+
+var legacyHash = flag.Bool("legacyhash", false, "accept a DB built with the legacy hash scheme")
+
+var skipVerify = flag.Bool("skipverify", false, "do not check loaded records against their parents' hashes")
+
+var format ads.Format
+
+var registry = ads.NewRegistry()
 
 func computeSize(value ads.ADS, trackc *verified.TrackC) int {
 	buffer := ads.GetFromPool()
@@ -27,6 +43,9 @@ func computeSize(value ads.ADS, trackc *verified.TrackC) int {
 	encoder := &ads.Encoder{
 		Writer:      buffer,
 		Transparent: trackc.Used,
+		Format:      format,
+		Registry:    registry,
+		Dedup:       *dedup,
 	}
 	encoder.Encode(&value)
 
@@ -70,18 +89,46 @@ func nextstep(h *seqhash.Hash, c comp.C) int {
 }
 
 func main() {
-	core.RegisterTypes()
-
 	flag.Parse()
 
-	db := core.ContinueDB(filepath.Join(*BaseDbPath, "balances"), *treapToken)
+	hasher, err := sha.ParseHasher(*hasherName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sha.Use(hasher)
+	if *legacyHash {
+		sha.UseScheme(sha.SchemeV1)
+	}
+
+	if err := core.RegisterTypes(registry); err != nil {
+		log.Fatal(err)
+	}
+	ads.UseRegistry(registry)
+
+	if format, err = ads.ParseFormat(*formatName); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("format: %v, dedup: %v\n", format, *dedup)
+
+	db, err := core.ContinueDB(filepath.Join(*BaseDbPath, "balances"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	token, err := db.Lookup(*treapRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	logtreap := new(verified.LogTreap)
 	logtreap.MakeOpaque()
-	ads.GetInfo(logtreap).Token = *treapToken
+	ads.GetInfo(logtreap).Token = token
 
-	pagingC := core.NewPagingC(db)
-	pagingC.Load(ads.GetInfo(logtreap))
+	pagingC := core.NewPagingC(db, registry)
+	pagingC.SkipVerify = *skipVerify
+	if err := pagingC.Load(ads.GetInfo(logtreap)); err != nil {
+		log.Fatal(err)
+	}
 
 	c := pagingC
 
@@ -6,6 +6,7 @@ import (
 	"certcomp/bitcoin/transactions"
 	"certcomp/bitrie"
 	"certcomp/comp"
+	"certcomp/sha"
 	"certcomp/verified"
 	"flag"
 	"fmt"
@@ -16,37 +17,71 @@ import (
 
 var BaseDbPath = flag.String("DbPath", "/x/4/jelle/db", "Where to store data.")
 
-var treapToken = flag.Int64("token", 0, "token from builder")
+var treapRoot = flag.String("token", "latest", "name of the state in the DB's manifest, or token from builder")
 
-func BitrieSize(balances bitrie.Bitrie, c comp.C) int {
-	c.Use(balances)
+var hasherName = flag.String("hasher", "sha256", "hash function the DB was built with")
 
-	if _, ok := balances.(*bitrie.BitrieLeaf); ok {
-		return 1
-	}
+var legacyHash = flag.Bool("legacyhash", false, "accept a DB built with the legacy hash scheme")
 
-	if node, ok := balances.(*bitrie.BitrieNode); ok {
-		return BitrieSize(node.Left, c) + BitrieSize(node.Right, c)
+var skipVerify = flag.Bool("skipverify", false, "do not check loaded records against their parents' hashes")
+
+func BitrieSize(balances bitrie.Bitrie, c comp.C) int {
+	size := 0
+
+	err := ads.Walk(balances, ads.Visitor{
+		Opaque: ads.LoadOpaque,
+		Pre: func(v *ads.Visit) error {
+			if _, ok := v.Value.(*bitrie.BitrieLeaf); ok {
+				size++
+				return ads.SkipChildren
+			}
+			return nil
+		},
+	}, c)
+	if err != nil {
+		log.Panic(err)
 	}
 
-	log.Panic("wut!")
-	return 0
+	return size
 }
 
 func main() {
-	core.RegisterTypes()
-	transactions.RegisterTypes()
-
 	flag.Parse()
 
-	db := core.ContinueDB(filepath.Join(*BaseDbPath, "transactions"), *treapToken)
+	hasher, err := sha.ParseHasher(*hasherName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sha.Use(hasher)
+	if *legacyHash {
+		sha.UseScheme(sha.SchemeV1)
+	}
+
+	registry := ads.NewRegistry()
+	if err := transactions.RegisterTypes(registry); err != nil {
+		log.Fatal(err)
+	}
+	ads.UseRegistry(registry)
+
+	db, err := core.ContinueDB(filepath.Join(*BaseDbPath, "transactions"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	token, err := db.Lookup(*treapRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	logtreap := new(verified.LogTreap)
 	logtreap.MakeOpaque()
-	ads.GetInfo(logtreap).Token = *treapToken
+	ads.GetInfo(logtreap).Token = token
 
-	pagingC := core.NewPagingC(db)
-	pagingC.Load(ads.GetInfo(logtreap))
+	pagingC := core.NewPagingC(db, registry)
+	pagingC.SkipVerify = *skipVerify
+	if err := pagingC.Load(ads.GetInfo(logtreap)); err != nil {
+		log.Fatal(err)
+	}
 
 	c := pagingC
 
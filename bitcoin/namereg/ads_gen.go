@@ -0,0 +1,36 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package namereg
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *Claim) Encode(e *ads.Encoder) {
+	e.WriteBytes(x.Key)
+}
+
+func (x *Claim) Decode(d *ads.Decoder) error {
+	{
+		value, err := d.ReadBytes()
+		if err != nil {
+			return err
+		}
+		x.Key = []byte(value)
+	}
+	return nil
+}
+
+func (x *Claim) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *Claim) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 1)
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&Claim{}, "Encode", "ComputeHash", "CollectChildren")
+}
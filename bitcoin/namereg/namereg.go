@@ -1,5 +1,7 @@
 package namereg
 
+//go:generate adsgen
+
 import (
 	"bytes"
 	"certcomp/ads"
@@ -111,9 +113,20 @@ func CalculateRegs(block *core.Block, c comp.C) (bitrie.Bitrie, bitrie.Bitrie) {
 	return res[0].(bitrie.Bitrie), res[1].(bitrie.Bitrie)
 }
 
-func RegisterTypes() {
-	ads.RegisterType(14, &Claim{})
+func RegisterTypes(r *ads.Registry) error {
+	if err := core.RegisterTypes(r); err != nil {
+		return err
+	}
+
+	n := r.Namespace("namereg")
+	n.RegisterType("Claim", &Claim{})
+
+	n.RegisterFunc("CalculateRegsImpl", CalculateRegsImpl)
+	n.RegisterFunc("ProcessTxnImpl", ProcessTxnImpl)
 
-	ads.RegisterFunc(7, CalculateRegsImpl)
-	ads.RegisterFunc(8, ProcessTxnImpl)
+	// Legacy ids continue the table in core.
+	n.SetLegacyId("Claim", 14)
+	n.SetLegacyId("CalculateRegsImpl", 7)
+	n.SetLegacyId("ProcessTxnImpl", 8)
+	return n.Err()
 }
@@ -0,0 +1,42 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package transactions
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *TxnChain) Encode(e *ads.Encoder) {
+	e.Encode(&x.Next)
+	e.Encode(&x.Txn)
+}
+
+func (x *TxnChain) Decode(d *ads.Decoder) error {
+	if err := d.Decode(&x.Next); err != nil {
+		return err
+	}
+	if err := d.Decode(&x.Txn); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *TxnChain) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *TxnChain) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 2)
+	if x.Next != nil {
+		children = append(children, x.Next)
+	}
+	if x.Txn != nil {
+		children = append(children, x.Txn)
+	}
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&TxnChain{}, "Encode", "ComputeHash", "CollectChildren")
+}
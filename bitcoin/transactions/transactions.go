@@ -1,5 +1,7 @@
 package transactions
 
+//go:generate adsgen
+
 import (
 	"certcomp/ads"
 	"certcomp/bitcoin/core"
@@ -80,11 +82,28 @@ func CalculateTxns(block *core.Block, c comp.C) bitrie.Bitrie {
 	return c.Call(CalculateTxnsImpl, block)[0].(bitrie.Bitrie)
 }
 
-func RegisterTypes() {
-	ads.RegisterType(12, &TxnChain{})
-	ads.RegisterType(13, &btcwire.TxOut{})
+func RegisterTypes(r *ads.Registry) error {
+	if err := core.RegisterTypes(r); err != nil {
+		return err
+	}
+	if err := r.RegisterType("btcwire.TxOut", &btcwire.TxOut{}); err != nil {
+		return err
+	}
+
+	n := r.Namespace("transactions")
+	n.RegisterType("TxnChain", &TxnChain{})
+
+	n.RegisterFunc("CalculateTxnsImpl", CalculateTxnsImpl)
+	n.RegisterFunc("ProcessTxnImpl", ProcessTxnImpl)
+	n.RegisterFunc("ProcessOutputImpl", ProcessOutputImpl)
 
-	ads.RegisterFunc(4, CalculateTxnsImpl)
-	ads.RegisterFunc(5, ProcessTxnImpl)
-	ads.RegisterFunc(6, ProcessOutputImpl)
+	// Legacy ids continue the table in core.
+	n.SetLegacyId("TxnChain", 12)
+	n.SetLegacyId("CalculateTxnsImpl", 4)
+	n.SetLegacyId("ProcessTxnImpl", 5)
+	n.SetLegacyId("ProcessOutputImpl", 6)
+	if err := n.Err(); err != nil {
+		return err
+	}
+	return r.SetLegacyId("btcwire.TxOut", 13)
 }
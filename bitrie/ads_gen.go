@@ -0,0 +1,50 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package bitrie
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *BitrieNil) Encode(e *ads.Encoder) {
+}
+
+func (x *BitrieNil) Decode(d *ads.Decoder) error {
+	return nil
+}
+
+func (x *Tuple) Encode(e *ads.Encoder) {
+	e.Encode(&x.A)
+	e.Encode(&x.B)
+}
+
+func (x *Tuple) Decode(d *ads.Decoder) error {
+	if err := d.Decode(&x.A); err != nil {
+		return err
+	}
+	if err := d.Decode(&x.B); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *Tuple) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *Tuple) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 2)
+	if !ads.IsNil(x.A) {
+		children = append(children, x.A)
+	}
+	if !ads.IsNil(x.B) {
+		children = append(children, x.B)
+	}
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&BitrieNil{}, "Encode")
+	ads.MarkGenerated(&Tuple{}, "Encode", "ComputeHash", "CollectChildren")
+}
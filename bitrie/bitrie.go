@@ -1,11 +1,12 @@
 package bitrie
 
+//go:generate adsgen
+
 import (
 	"certcomp/ads"
 	"certcomp/comp"
 	"certcomp/seqhash"
 	"certcomp/sha"
-	"encoding/binary"
 	"github.com/davecgh/go-spew/spew"
 )
 
@@ -63,7 +64,7 @@ func (n *BitrieNil) prepend(b Bits) Bitrie {
 }
 
 func (n *BitrieNil) ComputeHash() sha.Hash {
-	return sha.Sum([]byte{})
+	return sha.DomainSum("bitrie.Nil", []byte{})
 }
 
 func (n *BitrieNil) CollectChildren() []ads.ADS {
@@ -196,27 +197,23 @@ func (n *BitrieNode) ComputeHash() sha.Hash {
 	n.Bits.Canonicalize(buffer[0:32])
 	copy(buffer[32:64], ads.Hash(n.Left).Bytes())
 	copy(buffer[64:96], ads.Hash(n.Right).Bytes())
-	return sha.Sum(buffer[:])
+	return sha.DomainSum("bitrie.Node", buffer[:])
 }
 
 func (n *BitrieNode) Encode(e *ads.Encoder) {
-	var buffer [40]byte
-	copy(buffer[0:32], n.Bits.Bits[0:32])
-	binary.LittleEndian.PutUint32(buffer[32:36], uint32(n.Bits.Start))
-	binary.LittleEndian.PutUint32(buffer[36:40], uint32(n.Bits.Length))
-	e.Write(buffer[0:40])
+	n.Bits.encode(e)
 	e.Encode(&n.Left)
 	e.Encode(&n.Right)
 }
 
-func (n *BitrieNode) Decode(d *ads.Decoder) {
-	var buffer [40]byte
-	d.Read(buffer[:])
-	n.Bits.Bits = buffer[0:32]
-	n.Bits.Start = int32(binary.LittleEndian.Uint32(buffer[32:36]))
-	n.Bits.Length = int32(binary.LittleEndian.Uint32(buffer[36:40]))
-	d.Decode(&n.Left)
-	d.Decode(&n.Right)
+func (n *BitrieNode) Decode(d *ads.Decoder) error {
+	if err := n.Bits.decode(d); err != nil {
+		return err
+	}
+	if err := d.Decode(&n.Left); err != nil {
+		return err
+	}
+	return d.Decode(&n.Right)
 }
 
 func (n *BitrieNode) CollectChildren() []ads.ADS {
@@ -300,7 +297,7 @@ func (l *BitrieLeaf) ComputeHash() sha.Hash {
 		spew.Dump(l)
 	}
 	copy(buffer[32:64], ads.Hash(l.Value).Bytes())
-	return sha.Sum(buffer[:])
+	return sha.DomainSum("bitrie.Leaf", buffer[:])
 }
 
 func (n *BitrieLeaf) CollectChildren() []ads.ADS {
@@ -308,19 +305,22 @@ func (n *BitrieLeaf) CollectChildren() []ads.ADS {
 }
 
 func (n *BitrieLeaf) Encode(e *ads.Encoder) {
-	var buffer [40]byte
-	copy(buffer[0:32], n.Bits.Bits[0:32])
-	binary.LittleEndian.PutUint32(buffer[32:36], uint32(n.Bits.Start))
-	binary.LittleEndian.PutUint32(buffer[36:40], uint32(n.Bits.Length))
-	e.Write(buffer[0:40])
+	n.Bits.encode(e)
 	e.Encode(&n.Value)
 }
 
-func (n *BitrieLeaf) Decode(d *ads.Decoder) {
-	var buffer [40]byte
-	d.Read(buffer[:])
-	n.Bits.Bits = buffer[0:32]
-	n.Bits.Start = int32(binary.LittleEndian.Uint16(buffer[32:36]))
-	n.Bits.Length = int32(binary.LittleEndian.Uint16(buffer[36:40]))
-	d.Decode(&n.Value)
+func (n *BitrieLeaf) Decode(d *ads.Decoder) error {
+	if err := n.Bits.decode(d); err != nil {
+		return err
+	}
+	return d.Decode(&n.Value)
+}
+
+func RegisterTypes(r *ads.Registry) error {
+	n := r.Namespace("bitrie")
+	n.RegisterType("Leaf", &BitrieLeaf{})
+	n.RegisterType("Node", &BitrieNode{})
+	n.RegisterType("Nil", &BitrieNil{})
+	n.RegisterType("Tuple", &Tuple{})
+	return n.Err()
 }
@@ -1,6 +1,8 @@
 package bitrie
 
 import (
+	"bytes"
+	"certcomp/ads"
 	"certcomp/comp"
 	"certcomp/sha"
 	"fmt"
@@ -9,6 +11,20 @@ import (
 
 const stressN = 10000
 
+type testValue struct {
+	ads.Base
+	X interface{}
+}
+
+func val(x interface{}) *testValue {
+	return &testValue{X: x}
+}
+
+func valueIs(value ads.ADS, x interface{}) bool {
+	v, ok := value.(*testValue)
+	return ok && v.X == x
+}
+
 func TestBitrieStress(t *testing.T) {
 	trie := Nil
 	keys := make([]Bits, 0)
@@ -18,12 +34,12 @@ func TestBitrieStress(t *testing.T) {
 	}
 
 	for i := 0; i < stressN; i++ {
-		trie = trie.Set(keys[i], i, comp.NilC)
+		trie = trie.Set(keys[i], val(i), comp.NilC)
 	}
 
 	for i := 0; i < stressN; i++ {
 		value, found := trie.Get(keys[i], comp.NilC)
-		if !found || value != i {
+		if !found || !valueIs(value, i) {
 			t.Fatalf("missing %d", i)
 		}
 	}
@@ -39,7 +55,7 @@ func TestBitrieStress(t *testing.T) {
 				t.Fatalf("unexpected %d", i)
 			}
 		} else {
-			if !found || value != i {
+			if !found || !valueIs(value, i) {
 				t.Fatalf("missing %d", i)
 			}
 		}
@@ -54,14 +70,14 @@ func TestBitrieSimple(t *testing.T) {
 	c := MakeBits(sha.Sum([]byte("c")))
 	d := MakeBits(sha.Sum([]byte("d")))
 
-	trie = trie.Set(a, "a", comp.NilC)
-	trie = trie.Set(b, "b", comp.NilC)
-	trie = trie.Set(c, "c", comp.NilC)
-	trie = trie.Set(d, "d", comp.NilC)
+	trie = trie.Set(a, val("a"), comp.NilC)
+	trie = trie.Set(b, val("b"), comp.NilC)
+	trie = trie.Set(c, val("c"), comp.NilC)
+	trie = trie.Set(d, val("d"), comp.NilC)
 
 	trie = trie.Delete(b, comp.NilC)
 
-	if value, found := trie.Get(a, comp.NilC); value != "a" || !found {
+	if value, found := trie.Get(a, comp.NilC); !valueIs(value, "a") || !found {
 		t.Fatalf("no a")
 	}
 
@@ -69,11 +85,64 @@ func TestBitrieSimple(t *testing.T) {
 		t.Fatalf("got b")
 	}
 
-	if value, found := trie.Get(c, comp.NilC); value != "c" || !found {
+	if value, found := trie.Get(c, comp.NilC); !valueIs(value, "c") || !found {
 		t.Fatalf("no c")
 	}
 
-	if value, found := trie.Get(d, comp.NilC); value != "d" || !found {
+	if value, found := trie.Get(d, comp.NilC); !valueIs(value, "d") || !found {
 		t.Fatalf("no d")
 	}
 }
+
+func TestBitsDecodeOutOfRange(t *testing.T) {
+	cases := []Bits{
+		{Start: 256, Length: 0},
+		{Start: 255, Length: 2},
+		{Start: -1, Length: 1},
+	}
+	for _, format := range []ads.Format{ads.FixedFormat, ads.CompactFormat} {
+		for _, bits := range cases {
+			bits.Bits = make([]byte, 32)
+
+			buffer := new(bytes.Buffer)
+			if format == ads.CompactFormat {
+				e := &ads.Encoder{Writer: buffer, Format: format}
+				e.WriteUint(uint64(uint32(bits.Start)), 4)
+				e.WriteUint(uint64(bits.Length), 4)
+			} else {
+				bits.encode(&ads.Encoder{Writer: buffer, Format: format})
+			}
+
+			var decoded Bits
+			err := decoded.decode(&ads.Decoder{Reader: buffer, Format: format})
+			if _, ok := err.(*ads.MalformedError); !ok {
+				t.Errorf("%v start %d length %d: got %v, want a MalformedError", format, bits.Start, bits.Length, err)
+			}
+		}
+	}
+}
+
+func TestGeneratedTypedNil(t *testing.T) {
+	// Encoding interface values for SelfCheck names their types.
+	registry := ads.NewRegistry()
+	if err := RegisterTypes(registry); err != nil {
+		t.Fatal(err)
+	}
+	ads.UseRegistry(registry)
+
+	tuples := []*Tuple{
+		{A: &BitrieNil{}, B: &BitrieNil{}},
+		{A: (*BitrieLeaf)(nil), B: &BitrieNil{}},
+		{A: nil, B: (*BitrieNode)(nil)},
+	}
+	expected := []int{2, 1, 0}
+
+	for i, tuple := range tuples {
+		if children := tuple.CollectChildren(); len(children) != expected[i] {
+			t.Errorf("tuple %d has %d children, expected %d", i, len(children), expected[i])
+		}
+		if err := ads.SelfCheck(tuple); err != nil {
+			t.Errorf("tuple %d: %v", i, err)
+		}
+	}
+}
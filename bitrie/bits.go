@@ -1,7 +1,10 @@
 package bitrie
 
 import (
+	"certcomp/ads"
 	"certcomp/sha"
+	"encoding/binary"
+	"fmt"
 )
 
 type Bits struct {
@@ -34,6 +37,65 @@ func MakeBits(hash sha.Hash) Bits {
 	}
 }
 
+// Bits are encoded either as 32 raw bytes followed by the start and length,
+// or in CompactFormat as varint start and length followed by only the bytes
+// covering the range.
+func (b Bits) encode(e *ads.Encoder) {
+	if e.Format == ads.CompactFormat {
+		e.WriteUint(uint64(b.Start), 4)
+		e.WriteUint(uint64(b.Length), 4)
+		if b.Length > 0 {
+			var buffer [32]byte
+			b.Canonicalize(buffer[:])
+			e.Write(buffer[b.Start/8 : (b.Start+b.Length+7)/8])
+		}
+		return
+	}
+
+	var buffer [40]byte
+	copy(buffer[0:32], b.Bits[0:32])
+	binary.LittleEndian.PutUint32(buffer[32:36], uint32(b.Start))
+	binary.LittleEndian.PutUint32(buffer[36:40], uint32(b.Length))
+	e.Write(buffer[0:40])
+}
+
+func (b *Bits) decode(d *ads.Decoder) error {
+	if d.Format == ads.CompactFormat {
+		start, err := d.ReadUint(4)
+		if err != nil {
+			return err
+		}
+		length, err := d.ReadUint(4)
+		if err != nil {
+			return err
+		}
+		if start >= sha.Bits || start+length > sha.Bits {
+			return &ads.MalformedError{Reason: "bits out of range"}
+		}
+
+		b.Start = int32(start)
+		b.Length = int32(length)
+		b.Bits = make([]byte, 32)
+		if length > 0 {
+			return d.ReadFull(b.Bits[start/8 : (start+length+7)/8])
+		}
+		return nil
+	}
+
+	var buffer [40]byte
+	if err := d.ReadFull(buffer[:]); err != nil {
+		return err
+	}
+	b.Bits = buffer[0:32]
+	b.Start = int32(binary.LittleEndian.Uint32(buffer[32:36]))
+	b.Length = int32(binary.LittleEndian.Uint32(buffer[36:40]))
+
+	if b.Start < 0 || b.Start >= sha.Bits || b.Length < 0 || b.Start+b.Length > sha.Bits {
+		return &ads.MalformedError{Reason: "bits out of range"}
+	}
+	return nil
+}
+
 func (b Bits) Get(a int32) int {
 	a += b.Start
 	return int((b.Bits[a/8] >> uint(a%8)) & 1)
@@ -60,6 +122,49 @@ func (b Bits) String() string {
 	return s
 }
 
+// MarshalText writes b as its bits in order, preceded by a '.' for every
+// position before Start. Bits outside the range are not kept.
+func (b Bits) MarshalText() ([]byte, error) {
+	text := make([]byte, b.Start+b.Length)
+	for i := int32(0); i < b.Start; i++ {
+		text[i] = '.'
+	}
+	for i := int32(0); i < b.Length; i++ {
+		text[b.Start+i] = byte('0' + b.Get(i))
+	}
+	return text, nil
+}
+
+func (b *Bits) UnmarshalText(text []byte) error {
+	if len(text) > sha.Bits {
+		return fmt.Errorf("bitrie: %d bits do not fit in %d", len(text), sha.Bits)
+	}
+
+	start := 0
+	for start < len(text) && text[start] == '.' {
+		start++
+	}
+	if start >= sha.Bits {
+		return fmt.Errorf("bitrie: bits start past the end")
+	}
+
+	*b = Bits{
+		Start:  int32(start),
+		Length: int32(len(text) - start),
+		Bits:   make([]byte, 32),
+	}
+	for i, c := range text[start:] {
+		switch c {
+		case '0':
+		case '1':
+			b.Set(int32(i), 1)
+		default:
+			return fmt.Errorf("bitrie: bad bit %q", c)
+		}
+	}
+	return nil
+}
+
 func (b Bits) Cut(x, y int32) Bits {
 	r := Bits{
 		Length: y - x,
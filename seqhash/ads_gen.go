@@ -0,0 +1,127 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package seqhash
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *Hash) Encode(e *ads.Encoder) {
+	e.WriteInt(int64(x.Height), 1)
+	e.WriteLength(len(x.LeftFringes))
+	for i0 := range x.LeftFringes {
+		e.WriteLength(len(x.LeftFringes[i0]))
+		for i1 := range x.LeftFringes[i0] {
+			e.Encode(&x.LeftFringes[i0][i1])
+		}
+	}
+	e.WriteLength(len(x.Top))
+	for i0 := range x.Top {
+		e.Encode(&x.Top[i0])
+	}
+	e.WriteLength(len(x.RightFringes))
+	for i0 := range x.RightFringes {
+		e.WriteLength(len(x.RightFringes[i0]))
+		for i1 := range x.RightFringes[i0] {
+			e.Encode(&x.RightFringes[i0][i1])
+		}
+	}
+}
+
+func (x *Hash) Decode(d *ads.Decoder) error {
+	{
+		value, err := d.ReadInt(1)
+		if err != nil {
+			return err
+		}
+		x.Height = int8(value)
+	}
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.LeftFringes = make([][]Hashable, length)
+		for i0 := range x.LeftFringes {
+			{
+				length, err := d.ReadLength()
+				if err != nil {
+					return err
+				}
+				x.LeftFringes[i0] = make([]Hashable, length)
+				for i1 := range x.LeftFringes[i0] {
+					if err := d.Decode(&x.LeftFringes[i0][i1]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.Top = make([]Hashable, length)
+		for i0 := range x.Top {
+			if err := d.Decode(&x.Top[i0]); err != nil {
+				return err
+			}
+		}
+	}
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.RightFringes = make([][]Hashable, length)
+		for i0 := range x.RightFringes {
+			{
+				length, err := d.ReadLength()
+				if err != nil {
+					return err
+				}
+				x.RightFringes[i0] = make([]Hashable, length)
+				for i1 := range x.RightFringes[i0] {
+					if err := d.Decode(&x.RightFringes[i0][i1]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (x *Hash) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *Hash) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 4)
+	for i0 := range x.LeftFringes {
+		for i1 := range x.LeftFringes[i0] {
+			if !ads.IsNil(x.LeftFringes[i0][i1]) {
+				children = append(children, x.LeftFringes[i0][i1])
+			}
+		}
+	}
+	for i0 := range x.Top {
+		if !ads.IsNil(x.Top[i0]) {
+			children = append(children, x.Top[i0])
+		}
+	}
+	for i0 := range x.RightFringes {
+		for i1 := range x.RightFringes[i0] {
+			if !ads.IsNil(x.RightFringes[i0][i1]) {
+				children = append(children, x.RightFringes[i0][i1])
+			}
+		}
+	}
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&Hash{}, "Encode", "ComputeHash", "CollectChildren")
+}
@@ -1,5 +1,7 @@
 package seqhash
 
+//go:generate adsgen
+
 import (
 	"certcomp/ads"
 	"certcomp/comp"
@@ -39,7 +41,7 @@ func doRound(elems []Hashable, volatileLeft, volatileRight bool, c comp.C) round
 	for idx := uint(0); ; idx++ {
 		if idx > 0 && idx%sha.Bits == 0 {
 			for i := 0; i < N; i++ {
-				hashes[i] = sha.Sum(hashes[i].Bytes())
+				hashes[i] = sha.DomainSum("seqhash.Round", hashes[i].Bytes())
 			}
 		}
 
@@ -213,3 +215,9 @@ func (h *Hash) Finish(c comp.C) Hashable {
 
 	return elems[0]
 }
+
+func RegisterTypes(r *ads.Registry) error {
+	n := r.Namespace("seqhash")
+	n.RegisterType("Hash", &Hash{})
+	return n.Err()
+}
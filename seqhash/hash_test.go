@@ -47,7 +47,11 @@ const (
 )
 
 func TestMerge_Random(t *testing.T) {
-	ads.RegisterType(0, &X{})
+	registry := ads.NewRegistry()
+	if err := registry.RegisterType("seqhash_test.X", &X{}); err != nil {
+		t.Fatal(err)
+	}
+	ads.UseRegistry(registry)
 
 	rand.Seed(1)
 
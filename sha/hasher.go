@@ -0,0 +1,93 @@
+package sha
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A Hasher is one of the 256-bit hash functions Sum can use.
+type Hasher uint8
+
+const (
+	SHA256 Hasher = iota
+	SHA512_256
+	BLAKE2b256
+)
+
+var hasherNames = []string{
+	SHA256:     "sha256",
+	SHA512_256: "sha512/256",
+	BLAKE2b256: "blake2b-256",
+}
+
+func (h Hasher) String() string {
+	if int(h) < len(hasherNames) {
+		return hasherNames[h]
+	}
+	return fmt.Sprintf("Hasher(%d)", uint8(h))
+}
+
+func (h Hasher) Valid() bool {
+	return int(h) < len(hasherNames)
+}
+
+func ParseHasher(name string) (Hasher, error) {
+	for h, hasherName := range hasherNames {
+		if hasherName == name {
+			return Hasher(h), nil
+		}
+	}
+	return 0, fmt.Errorf("sha: unknown hasher %q", name)
+}
+
+func (h Hasher) Sum(data []byte) Hash {
+	switch h {
+	case SHA256:
+		return Hash(sha256.Sum256(data))
+	case SHA512_256:
+		return Hash(sha512.Sum512_256(data))
+	case BLAKE2b256:
+		return blake2b256(data)
+	default:
+		panic(h)
+	}
+}
+
+// The process's settings are read atomically, as any goroutine may hash.
+// started is set by the first Sum, after which they may no longer change.
+var (
+	current     = uint32(SHA256)
+	started     int32
+	settingLock sync.Mutex
+)
+
+// Use selects the Hasher that Sum uses for the whole process, shared by
+// every Registry and application in it. It must be set once, before
+// anything is hashed, as cached hashes are not recomputed: selecting
+// another Hasher after the first Sum panics.
+func Use(h Hasher) {
+	if !h.Valid() {
+		panic(h)
+	}
+	settingLock.Lock()
+	defer settingLock.Unlock()
+	if atomic.LoadInt32(&started) != 0 && Current() != h {
+		panic("sha: Use called after hashing started")
+	}
+	atomic.StoreUint32(&current, uint32(h))
+}
+
+// Current returns the Hasher selected with Use.
+func Current() Hasher {
+	return Hasher(atomic.LoadUint32(&current))
+}
+
+// start keeps the settings from changing from now on.
+func start() {
+	if atomic.LoadInt32(&started) == 0 {
+		atomic.StoreInt32(&started, 1)
+	}
+}
@@ -0,0 +1,87 @@
+package sha
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	block := strings.Repeat("a", 128)
+	long := strings.Repeat("a", 200)
+
+	vectors := []struct {
+		hasher   Hasher
+		input    string
+		expected string
+	}{
+		{SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512_256, "", "c672b8d1ef56ed28ab87c3622c5114069bdd3ad7b8f9737498d0c01ecef0967a"},
+		{SHA512_256, "abc", "53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23"},
+		{BLAKE2b256, "", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{BLAKE2b256, "abc", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{BLAKE2b256, block, "ae2aa48507885c4c950fb809b2076f959cde9f8ea6da260d9a3587df33dac450"},
+		{BLAKE2b256, long, "6b6e59aaf00eb730cf93de53560846722184bbd92f8368c21ffa95380c2f9fe6"},
+	}
+
+	for _, vector := range vectors {
+		if actual := vector.hasher.Sum([]byte(vector.input)).String(); actual != vector.expected {
+			t.Errorf("%v(%.10q) = %s, expected %s", vector.hasher, vector.input, actual, vector.expected)
+		}
+	}
+}
+
+func TestParseHasher(t *testing.T) {
+	for _, h := range []Hasher{SHA256, SHA512_256, BLAKE2b256} {
+		if parsed, err := ParseHasher(h.String()); err != nil || parsed != h {
+			t.Errorf("ParseHasher(%q) = %v, %v", h.String(), parsed, err)
+		}
+	}
+	if _, err := ParseHasher("md5"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestDomainSum(t *testing.T) {
+	data := []byte("data")
+
+	if SchemeV1.DomainSum(SHA256, "a", data) != SHA256.Sum(data) {
+		t.Errorf("SchemeV1 should ignore domains")
+	}
+
+	v2 := func(domain string, data []byte) Hash {
+		return SchemeV2.DomainSum(SHA256, domain, data)
+	}
+	if v2("a", data) == SHA256.Sum(data) || v2("a", data) == v2("b", data) {
+		t.Errorf("SchemeV2 should separate domains")
+	}
+	if v2("ab", []byte("c")) == v2("a", []byte("bc")) {
+		t.Errorf("domain boundary is ambiguous")
+	}
+	if DomainSum("a", data) != CurrentScheme().DomainSum(Current(), "a", data) {
+		t.Errorf("DomainSum ignores the process's settings")
+	}
+}
+
+func TestUseAfterSum(t *testing.T) {
+	Sum(nil)
+	Use(Current())
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected Use to panic after Sum")
+		}
+	}()
+	Use(BLAKE2b256)
+}
+
+func TestUseSchemeAfterSum(t *testing.T) {
+	Sum(nil)
+	UseScheme(CurrentScheme())
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected UseScheme to panic after Sum")
+		}
+	}()
+	UseScheme(SchemeV1)
+}
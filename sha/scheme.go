@@ -0,0 +1,72 @@
+package sha
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// A Scheme versions how data structures derive node hashes from Sum.
+type Scheme uint8
+
+const (
+	// SchemeV1 hashes the bytes of a node as they are, so nodes of
+	// different kinds share one namespace.
+	SchemeV1 Scheme = 1
+	// SchemeV2 prefixes the bytes of every node with the domain of its
+	// kind, so that no two kinds of node can have the same preimage.
+	SchemeV2 Scheme = 2
+)
+
+func (s Scheme) String() string {
+	return fmt.Sprintf("v%d", uint8(s))
+}
+
+func (s Scheme) Valid() bool {
+	return s == SchemeV1 || s == SchemeV2
+}
+
+var currentScheme = uint32(SchemeV2)
+
+// UseScheme selects the Scheme for the whole process. Like Use, it must be
+// set once, before anything is hashed; selecting another Scheme after the
+// first Sum panics.
+func UseScheme(s Scheme) {
+	if !s.Valid() {
+		panic(s)
+	}
+	settingLock.Lock()
+	defer settingLock.Unlock()
+	if atomic.LoadInt32(&started) != 0 && CurrentScheme() != s {
+		panic("sha: UseScheme called after hashing started")
+	}
+	atomic.StoreUint32(&currentScheme, uint32(s))
+}
+
+func CurrentScheme() Scheme {
+	return Scheme(atomic.LoadUint32(&currentScheme))
+}
+
+// DomainSum hashes data as a node of the kind named by domain, with the
+// process's Hasher and Scheme.
+func DomainSum(domain string, data []byte) Hash {
+	start()
+	return CurrentScheme().DomainSum(Current(), domain, data)
+}
+
+// DomainSum hashes data with h as a node of the kind named by domain. Under
+// SchemeV1 the domain is ignored; under SchemeV2 it is prefixed to data
+// along with its length.
+func (s Scheme) DomainSum(h Hasher, domain string, data []byte) Hash {
+	if s == SchemeV1 {
+		return h.Sum(data)
+	}
+
+	if len(domain) > 255 {
+		panic(domain)
+	}
+	buffer := make([]byte, 0, 1+len(domain)+len(data))
+	buffer = append(buffer, byte(len(domain)))
+	buffer = append(buffer, domain...)
+	buffer = append(buffer, data...)
+	return h.Sum(buffer)
+}
@@ -1,7 +1,12 @@
+// Package sha holds the hashes ADS values commit to. The hash function
+// and hashing scheme are settings of the whole process, not of a Registry
+// or an application: everything hashed in a process uses the Hasher and
+// Scheme selected with Use and UseScheme, which Registry fingerprints and
+// proofs record. Applications that need different hashers must run in
+// separate processes.
 package sha
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 )
 
@@ -9,9 +14,10 @@ type Hash [32]byte
 
 const Bits = 256
 
+// Sum hashes data with the Hasher selected with Use, SHA-256 by default.
 func Sum(data []byte) Hash {
-	hash := Hash(sha256.Sum256(data))
-	return hash
+	start()
+	return Current().Sum(data)
 }
 
 func (h Hash) Bytes() []byte {
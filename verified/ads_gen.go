@@ -0,0 +1,200 @@
+// Code generated by adsgen. DO NOT EDIT.
+
+package verified
+
+import (
+	"certcomp/ads"
+	"certcomp/sha"
+)
+
+func (x *LogEntry) Encode(e *ads.Encoder) {
+	e.WriteInt(int64(x.Type), 1)
+	e.WriteLength(len(x.ArgsOrResults))
+	for i0 := range x.ArgsOrResults {
+		e.Encode(&x.ArgsOrResults[i0])
+	}
+	e.Encode(&x.Func)
+	e.WriteInt(int64(x.Length), 4)
+}
+
+func (x *LogEntry) Decode(d *ads.Decoder) error {
+	{
+		value, err := d.ReadInt(1)
+		if err != nil {
+			return err
+		}
+		x.Type = EntryType(value)
+	}
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.ArgsOrResults = make([]interface{}, length)
+		for i0 := range x.ArgsOrResults {
+			if err := d.Decode(&x.ArgsOrResults[i0]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := d.Decode(&x.Func); err != nil {
+		return err
+	}
+	{
+		value, err := d.ReadInt(4)
+		if err != nil {
+			return err
+		}
+		x.Length = int32(value)
+	}
+	return nil
+}
+
+func (x *LogEntry) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *LogEntry) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 4)
+	for i0 := range x.ArgsOrResults {
+		children = ads.AppendChildren(children, &x.ArgsOrResults[i0])
+	}
+	children = ads.AppendChildren(children, &x.Func)
+	return children
+}
+
+func (x *LogTreap) Encode(e *ads.Encoder) {
+	e.Encode(&x.Value)
+	e.WriteInt(int64(x.Num), 4)
+	e.Encode(&x.Merged)
+	e.WriteInt(int64(x.Priority), 8)
+	e.Encode(&x.Left)
+	e.Encode(&x.Right)
+}
+
+func (x *LogTreap) Decode(d *ads.Decoder) error {
+	if err := d.Decode(&x.Value); err != nil {
+		return err
+	}
+	{
+		value, err := d.ReadInt(4)
+		if err != nil {
+			return err
+		}
+		x.Num = int32(value)
+	}
+	if err := d.Decode(&x.Merged); err != nil {
+		return err
+	}
+	{
+		value, err := d.ReadInt(8)
+		if err != nil {
+			return err
+		}
+		x.Priority = int64(value)
+	}
+	if err := d.Decode(&x.Left); err != nil {
+		return err
+	}
+	if err := d.Decode(&x.Right); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *LogTreap) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *LogTreap) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 6)
+	if x.Value != nil {
+		children = append(children, x.Value)
+	}
+	if x.Merged != nil {
+		children = append(children, x.Merged)
+	}
+	if x.Left != nil {
+		children = append(children, x.Left)
+	}
+	if x.Right != nil {
+		children = append(children, x.Right)
+	}
+	return children
+}
+
+func (x *LogTreeNode) Encode(e *ads.Encoder) {
+	e.WriteInt(int64(x.Num), 4)
+	e.Encode(&x.Left)
+	e.Encode(&x.Right)
+}
+
+func (x *LogTreeNode) Decode(d *ads.Decoder) error {
+	{
+		value, err := d.ReadInt(4)
+		if err != nil {
+			return err
+		}
+		x.Num = int32(value)
+	}
+	if err := d.Decode(&x.Left); err != nil {
+		return err
+	}
+	if err := d.Decode(&x.Right); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *LogTreeNode) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 3)
+	if !ads.IsNil(x.Left) {
+		children = append(children, x.Left)
+	}
+	if !ads.IsNil(x.Right) {
+		children = append(children, x.Right)
+	}
+	return children
+}
+
+func (x *Tmp) Encode(e *ads.Encoder) {
+	e.WriteLength(len(x.Log))
+	for i0 := range x.Log {
+		e.Encode(&x.Log[i0])
+	}
+}
+
+func (x *Tmp) Decode(d *ads.Decoder) error {
+	{
+		length, err := d.ReadLength()
+		if err != nil {
+			return err
+		}
+		x.Log = make([]LogEntry, length)
+		for i0 := range x.Log {
+			if err := d.Decode(&x.Log[i0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *Tmp) ComputeHash() sha.Hash {
+	return ads.EncodedHash(x)
+}
+
+func (x *Tmp) CollectChildren() []ads.ADS {
+	children := make([]ads.ADS, 0, 1)
+	for i0 := range x.Log {
+		children = ads.AppendChildren(children, &x.Log[i0])
+	}
+	return children
+}
+
+func init() {
+	ads.MarkGenerated(&LogEntry{}, "Encode", "ComputeHash", "CollectChildren")
+	ads.MarkGenerated(&LogTreap{}, "Encode", "ComputeHash", "CollectChildren")
+	ads.MarkGenerated(&LogTreeNode{}, "Encode", "CollectChildren")
+	ads.MarkGenerated(&Tmp{}, "Encode", "ComputeHash", "CollectChildren")
+}
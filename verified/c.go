@@ -49,8 +49,9 @@ type cacheInfo struct {
 }
 
 type ProofC struct {
-	Outer comp.C
-	Stack []*LogTreap
+	Outer    comp.C
+	Stack    []*LogTreap
+	Registry *ads.Registry
 
 	ToCache         int8
 	CachedLog       *LogTreap
@@ -72,7 +73,8 @@ func (c *ProofC) Call(f interface{}, args ...interface{}) []interface{} {
 	var exitEntry *LogEntry
 	var log *LogTreap
 
-	cacheFunc := ads.GetFuncId(f) == c.ToCache
+	id, found := c.Registry.FuncId(f)
+	cacheFunc := found && id == c.ToCache
 
 	if cacheFunc && c.Caching {
 		exitEntry = c.CachedExitEntry
@@ -198,12 +200,14 @@ func (c *ResolveC) Resolve() (next *LogEntry, err error) {
 	return
 }
 
-func NewProofC() *ProofC {
+func NewProofC(registry *ads.Registry) *ProofC {
 	return &ProofC{
 		Outer: &TrackC{
 			Outer: &VerifyC{},
 			Used:  make(map[ads.ADS]bool),
 		},
-		Stack: []*LogTreap{nil},
+		Stack:    []*LogTreap{nil},
+		Registry: registry,
+		ToCache:  -1,
 	}
 }
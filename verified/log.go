@@ -1,5 +1,7 @@
 package verified
 
+//go:generate adsgen
+
 import (
 	"certcomp/ads"
 	"certcomp/comp"
@@ -101,7 +103,7 @@ func (l *LogTreeNode) ComputeHash() sha.Hash {
 	binary.LittleEndian.PutUint32(buffer[0:4], uint32(l.Num))
 	copy(buffer[4:36], ads.Hash(l.Left).Bytes())
 	copy(buffer[36:68], ads.Hash(l.Right).Bytes())
-	return sha.Sum(buffer[:])
+	return sha.DomainSum("verified.LogTreeNode", buffer[:])
 }
 
 type LogTreap struct {
@@ -215,3 +217,11 @@ func CombineTreap(left, right *LogTreap, c comp.C) *LogTreap {
 		return right.UpdateLeft(CombineTreap(left, right.Left, c), c)
 	}
 }
+
+func RegisterTypes(r *ads.Registry) error {
+	n := r.Namespace("verified")
+	n.RegisterType("LogEntry", &LogEntry{})
+	n.RegisterType("LogTreeNode", &LogTreeNode{})
+	n.RegisterType("LogTreap", &LogTreap{})
+	return n.Err()
+}
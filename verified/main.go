@@ -4,7 +4,9 @@ import (
 	"certcomp/ads"
 	"certcomp/comp"
 	"certcomp/seqhash"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -68,24 +70,50 @@ func Resolve(lt LogTree, c comp.C) (*LogEntry, error) {
 	return resolveC.Resolve()
 }
 
-func verifiedMain() {
-	ads.RegisterType(0, &LogTreap{})
-	ads.RegisterType(1, &LogEntry{})
-	ads.RegisterType(2, &Tmp{})
-	ads.RegisterType(4, int64(0))
-	ads.RegisterType(5, &LogTreeNode{})
-	ads.RegisterType(6, &seqhash.Hash{})
+// ResolveProof reads a proof container, written by ads.WriteProof, whose
+// root is a commitment to a log, and resolves the entry that should follow
+// it. The proof must have been produced under the same registry.
+func ResolveProof(r io.Reader, registry *ads.Registry, c comp.C) (*LogEntry, error) {
+	proof, err := ads.ReadProof(r, ads.ReadOptions{Registry: registry})
+	if err != nil {
+		return nil, err
+	}
 
-	ads.RegisterFunc(0, fib)
+	h, ok := proof.Root.(*seqhash.Hash)
+	if !ok {
+		return nil, fmt.Errorf("proof root is a %s, not a commitment", proof.RootType)
+	}
 
-	c := NewProofC()
+	lt, ok := h.Finish(c).(LogTree)
+	if !ok {
+		return nil, errors.New("commitment is not to a log")
+	}
+	return Resolve(lt, c)
+}
+
+func verifiedMain() {
+	registry := ads.NewRegistry()
+	if err := RegisterTypes(registry); err != nil {
+		panic(err)
+	}
+	if err := seqhash.RegisterTypes(registry); err != nil {
+		panic(err)
+	}
+	registry.RegisterType("verified.Tmp", &Tmp{})
+	registry.RegisterType("int64", int64(0))
+	registry.RegisterFunc("verified.fib", fib)
+	ads.UseRegistry(registry)
+
+	// Cache fib calls, as when fib had the default id 0.
+	c := NewProofC(registry)
+	c.ToCache, _ = registry.FuncId(fib)
 	fmt.Printf("fib(5) = %d\n", Fib(5, c))
 
 	/*
 		log := c.stack[0]
 
 		seqHash := log.Slice(0, 10000)
-		c = NewProofC()
+		c = NewProofC(registry)
 		next, err := Resolve(seqHash.Finish(c).(LogTree), c)
 		spew.Dump(next, err)
 